@@ -0,0 +1,52 @@
+// Command admin performs operator tasks that must work before any admin
+// account exists, such as granting the first admin role:
+//
+//	go run ./cmd/admin grant-role <username|email> <customer|support|admin>
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"cs3604/backend/internal/config"
+	"cs3604/backend/internal/db"
+	"cs3604/backend/internal/repo"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin grant-role <username|email> <role>")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) != 4 || os.Args[1] != "grant-role" {
+		usage()
+	}
+	identifier, role := os.Args[2], os.Args[3]
+
+	gdb, err := db.Open(config.LoadDB().DSN())
+	if err != nil {
+		log.Fatalf("db open: %v", err)
+	}
+	r := repo.New(gdb)
+	roles, err := r.EnumValues("user_role_enum")
+	if err != nil {
+		log.Fatalf("load roles: %v", err)
+	}
+	valid := false
+	for _, v := range roles {
+		valid = valid || v == role
+	}
+	if !valid {
+		log.Fatalf("unknown role %q (want one of %v)", role, roles)
+	}
+	n, err := r.SetUserRole(identifier, role)
+	if err != nil {
+		log.Fatalf("grant role: %v", err)
+	}
+	if n == 0 {
+		log.Fatalf("no active account matches %q", identifier)
+	}
+	fmt.Printf("%s is now %s\n", identifier, role)
+}
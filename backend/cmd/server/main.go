@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"cs3604/backend/internal/config"
 	"cs3604/backend/internal/db"
 	"cs3604/backend/internal/server"
+	"cs3604/backend/internal/sweeper"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,6 +26,22 @@ func main() {
 	}
 	srv := server.New(gdb)
 
+	// every instance runs a sweeper; they skip each other's locked rows
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go sweeper.New(gdb, config.LoadSweeper()).Run(ctx)
+
+	if addr := config.LoadMetrics().Addr; addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", expvar.Handler())
+		go func() {
+			log.Printf("metrics listening on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Printf("metrics listener: %v", err)
+			}
+		}()
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -3,6 +3,9 @@ package config
 import (
     "fmt"
     "os"
+    "strconv"
+    "strings"
+    "time"
 )
 
 type DBConfig struct {
@@ -31,9 +34,225 @@ func (c DBConfig) DSN() string {
         c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
 }
 
+type AuthConfig struct {
+    // SessionIdleTTL applies to logins without rememberMe; the cookie lives only for the browser session.
+    SessionIdleTTL time.Duration
+    // SessionRememberTTL applies to rememberMe logins and is slid forward on activity.
+    SessionRememberTTL time.Duration
+    // SessionAbsoluteTTL caps any session's lifetime regardless of activity.
+    SessionAbsoluteTTL time.Duration
+
+    // LoginFailureWindow is how far back failed logins are counted.
+    LoginFailureWindow time.Duration
+    // LoginDelayAfter failures start a doubling delay between attempts.
+    LoginDelayAfter int
+    // LoginLockThreshold failures lock an identifier for LoginLockDuration.
+    LoginLockThreshold int
+    LoginLockDuration  time.Duration
+    // LoginIPThreshold failures from one IP across all identifiers are rate limited.
+    LoginIPThreshold int
+    // OTPIPPerHour caps the one-time codes texted per hour on behalf of one
+    // IP across all numbers, since every text costs money.
+    OTPIPPerHour int
+    // TrustedProxies are the addresses or CIDRs whose X-Forwarded-For header is
+    // believed when working out the client IP. Empty means the header is
+    // ignored and the connection's peer address is used.
+    TrustedProxies []string
+
+    // AppBaseURL is the frontend origin used to build links in emails.
+    AppBaseURL       string
+    PasswordResetTTL time.Duration
+    EmailVerifyTTL   time.Duration
+
+    // CookieSecure marks session cookies Secure; enable it whenever the API is served over HTTPS.
+    CookieSecure bool
+    // CookieSameSite is "lax", "strict" or "none" (which also requires CookieSecure).
+    CookieSameSite string
+}
+
+func LoadAuth() AuthConfig {
+    return AuthConfig{
+        SessionIdleTTL:     getenvDuration("SESSION_IDLE_TTL", 30*time.Minute),
+        SessionRememberTTL: getenvDuration("SESSION_REMEMBER_TTL", 7*24*time.Hour),
+        SessionAbsoluteTTL: getenvDuration("SESSION_ABSOLUTE_TTL", 30*24*time.Hour),
+        LoginFailureWindow: getenvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+        LoginDelayAfter:    getenvInt("LOGIN_DELAY_AFTER", 3),
+        LoginLockThreshold: getenvInt("LOGIN_LOCK_THRESHOLD", 10),
+        LoginLockDuration:  getenvDuration("LOGIN_LOCK_DURATION", 15*time.Minute),
+        LoginIPThreshold:   getenvInt("LOGIN_IP_THRESHOLD", 50),
+        OTPIPPerHour:       getenvInt("OTP_IP_PER_HOUR", 20),
+        TrustedProxies:     getenvList("TRUSTED_PROXIES"),
+        AppBaseURL:         getenv("APP_BASE_URL", "http://localhost:5173"),
+        PasswordResetTTL:   getenvDuration("PASSWORD_RESET_TTL", 30*time.Minute),
+        EmailVerifyTTL:     getenvDuration("EMAIL_VERIFY_TTL", 24*time.Hour),
+        CookieSecure:       getenvBool("COOKIE_SECURE", false),
+        CookieSameSite:     getenv("COOKIE_SAMESITE", "lax"),
+    }
+}
+
+type PasswordConfig struct {
+    // Algorithm is "bcrypt" or "argon2id"; hashes made under other settings
+    // are upgraded on the next successful login.
+    Algorithm     string
+    BcryptCost    int
+    Argon2Memory  uint32 // KiB
+    Argon2Time    uint32
+    Argon2Threads uint8
+}
+
+func LoadPassword() PasswordConfig {
+    return PasswordConfig{
+        Algorithm:     getenv("PASSWORD_ALGORITHM", "bcrypt"),
+        BcryptCost:    getenvInt("BCRYPT_COST", 10),
+        Argon2Memory:  uint32(getenvInt("ARGON2_MEMORY_KB", 64*1024)),
+        Argon2Time:    uint32(getenvInt("ARGON2_TIME", 3)),
+        Argon2Threads: uint8(getenvInt("ARGON2_THREADS", 2)),
+    }
+}
+
+// OIDCConfig enables "sign in with" an external OpenID Connect provider when
+// Issuer is set.
+type OIDCConfig struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    // RedirectURL is the frontend page that receives the code and posts it
+    // to /auth/oidc/callback.
+    RedirectURL string
+    // LinkByEmail links a first-time subject to the local account with the
+    // same verified email. Off by default: it lets the provider choose which
+    // account it signs in to. Without it, subjects are linked by signing in
+    // locally first.
+    LinkByEmail bool
+}
+
+func LoadOIDC() OIDCConfig {
+    return OIDCConfig{
+        Issuer:       os.Getenv("OIDC_ISSUER"),
+        ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+        ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+        RedirectURL:  getenv("OIDC_REDIRECT_URL", getenv("APP_BASE_URL", "http://localhost:5173")+"/oidc/callback"),
+        LinkByEmail:  getenvBool("OIDC_LINK_BY_EMAIL", false),
+    }
+}
+
+type SeedConfig struct {
+    // Dir holds the idempotent seed scripts run by POST /admin/init-seed.
+    Dir string
+}
+
+func LoadSeed() SeedConfig {
+    return SeedConfig{Dir: getenv("SEED_DIR", "../init-scripts")}
+}
+
+// SweeperConfig controls the background job that expires overdue
+// preorders. An Interval of 0 turns it off.
+type SweeperConfig struct {
+    Interval  time.Duration
+    BatchSize int
+}
+
+func LoadSweeper() SweeperConfig {
+    return SweeperConfig{
+        Interval:  getenvDuration("PREORDER_SWEEP_INTERVAL", 30*time.Second),
+        BatchSize: getenvInt("PREORDER_SWEEP_BATCH", 500),
+    }
+}
+
+// MetricsConfig serves expvar on a separate listener so a scraper can read
+// it without an admin session. Addr must only be reachable from inside the
+// deployment; empty turns the listener off.
+type MetricsConfig struct {
+    Addr string
+}
+
+func LoadMetrics() MetricsConfig {
+    return MetricsConfig{Addr: os.Getenv("METRICS_ADDR")}
+}
+
+type MailConfig struct {
+    SMTPHost     string
+    SMTPPort     string
+    SMTPUser     string
+    SMTPPassword string
+    From         string
+    // Without an SMTP host, mail is only written to OutboxDir when
+    // DevOutbox is explicitly enabled.
+    DevOutbox bool
+    OutboxDir string
+}
+
+func LoadMail() MailConfig {
+    return MailConfig{
+        SMTPHost:     os.Getenv("SMTP_HOST"),
+        SMTPPort:     getenv("SMTP_PORT", "587"),
+        SMTPUser:     os.Getenv("SMTP_USER"),
+        SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+        From:         getenv("MAIL_FROM", "12306 <no-reply@localhost>"),
+        DevOutbox:    getenvBool("MAIL_DEV_OUTBOX", false),
+        OutboxDir:    getenv("MAIL_OUTBOX_DIR", "outbox"),
+    }
+}
+
+// SMSConfig selects how one-time codes are texted. Without a gateway, codes
+// are only written to OutboxDir when DevOutbox is explicitly enabled.
+type SMSConfig struct {
+    GatewayURL string
+    APIKey     string
+    DevOutbox  bool
+    OutboxDir  string
+}
+
+func LoadSMS() SMSConfig {
+    return SMSConfig{
+        GatewayURL: os.Getenv("SMS_GATEWAY_URL"),
+        APIKey:     os.Getenv("SMS_API_KEY"),
+        DevOutbox:  getenvBool("SMS_DEV_OUTBOX", false),
+        OutboxDir:  getenv("SMS_OUTBOX_DIR", "outbox"),
+    }
+}
+
 func getenv(k, def string) string {
     if v := os.Getenv(k); v != "" {
         return v
     }
     return def
-}
\ No newline at end of file
+}
+
+func getenvDuration(k string, def time.Duration) time.Duration {
+    if v := os.Getenv(k); v != "" {
+        if d, err := time.ParseDuration(v); err == nil {
+            return d
+        }
+    }
+    return def
+}
+
+func getenvInt(k string, def int) int {
+    if v := os.Getenv(k); v != "" {
+        if n, err := strconv.Atoi(v); err == nil {
+            return n
+        }
+    }
+    return def
+}
+
+// getenvList splits a comma-separated variable, dropping empty entries.
+func getenvList(k string) []string {
+    var out []string
+    for _, v := range strings.Split(os.Getenv(k), ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            out = append(out, v)
+        }
+    }
+    return out
+}
+
+func getenvBool(k string, def bool) bool {
+    if v := os.Getenv(k); v != "" {
+        if b, err := strconv.ParseBool(v); err == nil {
+            return b
+        }
+    }
+    return def
+}
@@ -18,6 +18,7 @@ type User struct {
     DateOfBirth *time.Time
     Gender    *string
     Status    string         `gorm:"default:active"`
+    Role      string         `gorm:"type:user_role_enum;default:customer"`
     LastLoginAt *time.Time
     CreatedAt time.Time      `gorm:"default:now()"`
     UpdatedAt time.Time      `gorm:"default:now()"`
@@ -0,0 +1,156 @@
+package notify
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/tls"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net"
+    "net/mail"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "cs3604/backend/internal/config"
+)
+
+// Message is a plain-text email.
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer delivers transactional email such as password reset links.
+type Mailer interface {
+    Send(ctx context.Context, msg Message) error
+}
+
+// ErrMailDisabled is returned when no SMTP server is configured.
+var ErrMailDisabled = errors.New("mail: no SMTP host configured")
+
+// smtpTimeout bounds a whole SMTP conversation when the caller's context
+// has no earlier deadline.
+const smtpTimeout = 10 * time.Second
+
+// NewMailer returns an SMTP mailer when SMTP_HOST is configured. Otherwise
+// mail goes to the outbox directory if MAIL_DEV_OUTBOX is set, and is
+// refused if not, so a misconfigured deployment never writes reset or
+// verification links to disk.
+func NewMailer(cfg config.MailConfig) Mailer {
+    if cfg.SMTPHost != "" {
+        return &SMTPMailer{Addr: net.JoinHostPort(cfg.SMTPHost, cfg.SMTPPort), Username: cfg.SMTPUser, Password: cfg.SMTPPassword, From: cfg.From}
+    }
+    if cfg.DevOutbox {
+        return &FileMailer{Dir: cfg.OutboxDir, From: cfg.From}
+    }
+    return DisabledMailer{}
+}
+
+type SMTPMailer struct {
+    Addr     string
+    Username string
+    Password string
+    From     string
+}
+
+// Send delivers msg like smtp.SendMail, but dials with ctx and gives up
+// once ctx is done or smtpTimeout has passed, so a stalled server cannot
+// hang the request that sends the mail.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+    ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+    defer cancel()
+    conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", m.Addr)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    deadline, _ := ctx.Deadline()
+    if err := conn.SetDeadline(deadline); err != nil {
+        return err
+    }
+    // closing the connection unblocks any read or write when ctx is canceled
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+
+    host, _, _ := net.SplitHostPort(m.Addr)
+    c, err := smtp.NewClient(conn, host)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+            return err
+        }
+    }
+    if m.Username != "" {
+        if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+            return err
+        }
+    }
+    envelope := m.From
+    if addr, err := mail.ParseAddress(m.From); err == nil {
+        envelope = addr.Address
+    }
+    if err := c.Mail(envelope); err != nil {
+        return err
+    }
+    if err := c.Rcpt(msg.To); err != nil {
+        return err
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(render(m.From, msg)); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
+
+// FileMailer drops each message as an .eml file into Dir, for development
+// and tests where no SMTP server is available. Files are private to the
+// server's user since they carry live tokens.
+type FileMailer struct {
+    Dir  string
+    From string
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+    if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+        return err
+    }
+    var rnd [4]byte
+    if _, err := rand.Read(rnd[:]); err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), hex.EncodeToString(rnd[:]))
+    return os.WriteFile(filepath.Join(m.Dir, name), render(m.From, msg), 0o600)
+}
+
+// DisabledMailer refuses every message.
+type DisabledMailer struct{}
+
+func (DisabledMailer) Send(ctx context.Context, msg Message) error {
+    return ErrMailDisabled
+}
+
+func render(from string, msg Message) []byte {
+    var b strings.Builder
+    fmt.Fprintf(&b, "From: %s\r\n", from)
+    fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+    fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+    fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return []byte(b.String())
+}
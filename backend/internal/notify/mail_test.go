@@ -0,0 +1,69 @@
+package notify
+
+import (
+    "context"
+    "errors"
+    "net"
+    "os"
+    "testing"
+    "time"
+
+    "cs3604/backend/internal/config"
+)
+
+func TestNewMailerNeedsSMTPOrDevOutbox(t *testing.T) {
+    m := NewMailer(config.MailConfig{OutboxDir: t.TempDir()})
+    if err := m.Send(context.Background(), Message{To: "a@example.com"}); !errors.Is(err, ErrMailDisabled) {
+        t.Fatalf("expected ErrMailDisabled, got %v", err)
+    }
+    if _, ok := NewMailer(config.MailConfig{DevOutbox: true}).(*FileMailer); !ok {
+        t.Fatal("expected a FileMailer with MAIL_DEV_OUTBOX")
+    }
+}
+
+func TestFileMailerWritesPrivateFiles(t *testing.T) {
+    dir := t.TempDir() + "/outbox"
+    m := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+    if err := m.Send(context.Background(), Message{To: "a@example.com", Subject: "Reset", Body: "token"}); err != nil {
+        t.Fatal(err)
+    }
+    if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0o700 {
+        t.Fatalf("outbox dir: %v %v", fi.Mode().Perm(), err)
+    }
+    files, err := os.ReadDir(dir)
+    if err != nil || len(files) != 1 {
+        t.Fatalf("outbox: %v %v", files, err)
+    }
+    if fi, err := files[0].Info(); err != nil || fi.Mode().Perm() != 0o600 {
+        t.Fatalf("message file: %v %v", fi.Mode().Perm(), err)
+    }
+}
+
+func TestSMTPMailerGivesUpOnSilentServer(t *testing.T) {
+    // accepts connections but never sends the greeting
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    err = (&SMTPMailer{Addr: ln.Addr().String(), From: "no-reply@example.com"}).Send(ctx, Message{To: "a@example.com"})
+    if err == nil {
+        t.Fatal("expected an error from a silent server")
+    }
+    if d := time.Since(start); d > 2*time.Second {
+        t.Fatalf("Send took %v despite the deadline", d)
+    }
+}
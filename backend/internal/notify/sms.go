@@ -0,0 +1,95 @@
+package notify
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+
+    "cs3604/backend/internal/config"
+)
+
+// SMSSender delivers short text messages such as one-time codes.
+type SMSSender interface {
+    SendSMS(ctx context.Context, to, text string) error
+}
+
+// ErrSMSDisabled is returned when no SMS gateway is configured.
+var ErrSMSDisabled = errors.New("sms: no gateway configured")
+
+// NewSMSSender returns a gateway sender when SMS_GATEWAY_URL is configured.
+// Otherwise texts go to the outbox directory if SMS_DEV_OUTBOX is set, and
+// are refused if not, so a misconfigured deployment never writes codes to
+// disk or logs.
+func NewSMSSender(cfg config.SMSConfig) SMSSender {
+    if cfg.GatewayURL != "" {
+        return &HTTPSMSSender{URL: cfg.GatewayURL, APIKey: cfg.APIKey, Client: &http.Client{Timeout: 10 * time.Second}}
+    }
+    if cfg.DevOutbox {
+        return &FileSMSSender{Dir: cfg.OutboxDir}
+    }
+    return DisabledSMSSender{}
+}
+
+// HTTPSMSSender posts {"to", "text"} as JSON to an SMS gateway.
+type HTTPSMSSender struct {
+    URL    string
+    APIKey string
+    Client *http.Client
+}
+
+func (s *HTTPSMSSender) SendSMS(ctx context.Context, to, text string) error {
+    body, err := json.Marshal(map[string]string{"to": to, "text": text})
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if s.APIKey != "" {
+        req.Header.Set("Authorization", "Bearer "+s.APIKey)
+    }
+    resp, err := s.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("sms gateway: %s", resp.Status)
+    }
+    return nil
+}
+
+// FileSMSSender drops each text as a .sms file into Dir, for local
+// development without a gateway.
+type FileSMSSender struct {
+    Dir string
+}
+
+func (s *FileSMSSender) SendSMS(ctx context.Context, to, text string) error {
+    if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+        return err
+    }
+    var rnd [4]byte
+    if _, err := rand.Read(rnd[:]); err != nil {
+        return err
+    }
+    name := fmt.Sprintf("%s-%s.sms", time.Now().Format("20060102T150405.000000000"), hex.EncodeToString(rnd[:]))
+    return os.WriteFile(filepath.Join(s.Dir, name), []byte("To: "+to+"\n\n"+text+"\n"), 0o600)
+}
+
+// DisabledSMSSender refuses every message.
+type DisabledSMSSender struct{}
+
+func (DisabledSMSSender) SendSMS(ctx context.Context, to, text string) error {
+    return ErrSMSDisabled
+}
@@ -0,0 +1,348 @@
+// Package oidc implements the relying-party side of the OpenID Connect
+// authorization code flow with PKCE: discovery, the authorization URL, the
+// code exchange and RS256 ID token validation against the issuer's JWKS.
+package oidc
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+var (
+    ErrInvalidToken = errors.New("oidc: invalid id token")
+    ErrExchange     = errors.New("oidc: code exchange failed")
+)
+
+// clockSkew is tolerated on exp and iat.
+const clockSkew = 2 * time.Minute
+
+// jwksMinRefresh spaces out JWKS downloads, so tokens naming made-up kids
+// cannot make the provider hammer the issuer.
+const jwksMinRefresh = time.Minute
+
+// Config identifies the client at one issuer.
+type Config struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    RedirectURL  string
+    Scopes       []string
+    // LinkByEmail lets the application link a first-time subject to the
+    // local account with the same verified email. Only enable it for
+    // providers trusted to verify addresses.
+    LinkByEmail bool
+}
+
+// Claims are the ID token claims the application uses.
+type Claims struct {
+    Issuer          string   `json:"iss"`
+    Subject         string   `json:"sub"`
+    Audience        audience `json:"aud"`
+    AuthorizedParty string   `json:"azp"`
+    Expiry          int64    `json:"exp"`
+    IssuedAt        int64    `json:"iat"`
+    Nonce           string   `json:"nonce"`
+    Email           string   `json:"email"`
+    EmailVerified   bool     `json:"email_verified"`
+    Name            string   `json:"name"`
+}
+
+// audience accepts both the string and the array form of "aud".
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+    var one string
+    if err := json.Unmarshal(b, &one); err == nil {
+        *a = audience{one}
+        return nil
+    }
+    var many []string
+    if err := json.Unmarshal(b, &many); err != nil {
+        return err
+    }
+    *a = many
+    return nil
+}
+
+type discovery struct {
+    Issuer                string `json:"issuer"`
+    AuthorizationEndpoint string `json:"authorization_endpoint"`
+    TokenEndpoint         string `json:"token_endpoint"`
+    JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one issuer. Discovery and keys are fetched lazily and
+// cached; keys are refetched when a token names an unknown kid, at most once
+// per jwksMinRefresh.
+type Provider struct {
+    cfg    Config
+    client *http.Client
+
+    mu          sync.Mutex
+    meta        *discovery
+    keys        map[string]*rsa.PublicKey
+    keysFetched time.Time
+    // refreshMu lets one caller download the JWKS while others wait for it.
+    refreshMu sync.Mutex
+}
+
+func New(cfg Config) *Provider {
+    if len(cfg.Scopes) == 0 {
+        cfg.Scopes = []string{"openid", "email", "profile"}
+    }
+    return &Provider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Issuer is the configured issuer URL, used to namespace subjects.
+func (p *Provider) Issuer() string { return p.cfg.Issuer }
+
+// LinkByEmail reports whether verified emails may link accounts.
+func (p *Provider) LinkByEmail() bool { return p.cfg.LinkByEmail }
+
+func (p *Provider) getJSON(ctx context.Context, u string, v any) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("oidc: GET %s: %s", u, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.meta != nil {
+        return p.meta, nil
+    }
+    var d discovery
+    if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+        return nil, err
+    }
+    if d.Issuer != p.cfg.Issuer {
+        return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+    }
+    p.meta = &d
+    return p.meta, nil
+}
+
+// PKCE returns a random code verifier and its S256 challenge.
+func PKCE() (verifier, challenge string, err error) {
+    verifier, err = RandomString()
+    if err != nil {
+        return "", "", err
+    }
+    return verifier, S256(verifier), nil
+}
+
+// S256 is the PKCE code challenge for verifier.
+func S256(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RandomString returns 32 random bytes, base64url encoded, for state and nonce.
+func RandomString() (string, error) {
+    var b [32]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// AuthURL is where the browser is sent to sign in.
+func (p *Provider) AuthURL(ctx context.Context, state, nonce, challenge string) (string, error) {
+    d, err := p.discover(ctx)
+    if err != nil {
+        return "", err
+    }
+    q := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {p.cfg.ClientID},
+        "redirect_uri":          {p.cfg.RedirectURL},
+        "scope":                 {strings.Join(p.cfg.Scopes, " ")},
+        "state":                 {state},
+        "nonce":                 {nonce},
+        "code_challenge":        {challenge},
+        "code_challenge_method": {"S256"},
+    }
+    sep := "?"
+    if strings.Contains(d.AuthorizationEndpoint, "?") {
+        sep = "&"
+    }
+    return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens and returns the
+// validated ID token claims.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+    d, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    form := url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {p.cfg.RedirectURL},
+        "code_verifier": {verifier},
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    var tok struct {
+        IDToken string `json:"id_token"`
+        Error   string `json:"error"`
+    }
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+        return nil, fmt.Errorf("%w: %s %s", ErrExchange, resp.Status, tok.Error)
+    }
+    return p.Verify(ctx, tok.IDToken, nonce)
+}
+
+// Verify checks the signature and standard claims of a raw ID token.
+func (p *Provider) Verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+    parts := strings.Split(raw, ".")
+    if len(parts) != 3 {
+        return nil, ErrInvalidToken
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "RS256" {
+        return nil, ErrInvalidToken
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, ErrInvalidToken
+    }
+    key, err := p.key(ctx, header.Kid)
+    if err != nil {
+        return nil, err
+    }
+    digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+    if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+        return nil, ErrInvalidToken
+    }
+    var c Claims
+    if err := decodeSegment(parts[1], &c); err != nil {
+        return nil, ErrInvalidToken
+    }
+    now := time.Now()
+    switch {
+    case c.Issuer != p.cfg.Issuer,
+        c.Subject == "",
+        !containsString(c.Audience, p.cfg.ClientID),
+        len(c.Audience) > 1 && c.AuthorizedParty != p.cfg.ClientID,
+        now.After(time.Unix(c.Expiry, 0).Add(clockSkew)),
+        time.Unix(c.IssuedAt, 0).After(now.Add(clockSkew)),
+        c.Nonce != nonce:
+        return nil, ErrInvalidToken
+    }
+    return &c, nil
+}
+
+func decodeSegment(seg string, v any) error {
+    b, err := base64.RawURLEncoding.DecodeString(seg)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(b, v)
+}
+
+func containsString(list []string, v string) bool {
+    for _, x := range list {
+        if x == v {
+            return true
+        }
+    }
+    return false
+}
+
+// key returns the signing key for kid, refreshing the JWKS on a miss so that
+// key rotation at the issuer is picked up. Refreshes are rate limited; a kid
+// still unknown after the latest download is rejected.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+    lookup := func() (*rsa.PublicKey, bool, time.Time) {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        k, ok := p.keys[kid]
+        return k, ok, p.keysFetched
+    }
+    if k, ok, _ := lookup(); ok {
+        return k, nil
+    }
+    p.refreshMu.Lock()
+    defer p.refreshMu.Unlock()
+    // another caller may have refreshed while this one waited
+    k, ok, fetched := lookup()
+    if ok {
+        return k, nil
+    }
+    if !fetched.IsZero() && time.Since(fetched) < jwksMinRefresh {
+        return nil, ErrInvalidToken
+    }
+    d, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+    var set struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Kid string `json:"kid"`
+            Use string `json:"use"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+        return nil, err
+    }
+    keys := map[string]*rsa.PublicKey{}
+    for _, jwk := range set.Keys {
+        if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+            continue
+        }
+        n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+        e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+        if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+            continue
+        }
+        keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+    p.mu.Lock()
+    p.keys, p.keysFetched = keys, time.Now()
+    p.mu.Unlock()
+    if k, ok := keys[kid]; ok {
+        return k, nil
+    }
+    return nil, ErrInvalidToken
+}
@@ -0,0 +1,137 @@
+package oidc_test
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "fmt"
+    "net/http"
+    "net/url"
+    "testing"
+    "time"
+
+    "cs3604/backend/internal/oidc"
+    "cs3604/backend/internal/oidc/oidctest"
+    "github.com/stretchr/testify/require"
+)
+
+func newProvider(t *testing.T) (*oidctest.Issuer, *oidc.Provider) {
+    iss, err := oidctest.NewIssuer("web-client", "s3cret")
+    require.NoError(t, err)
+    t.Cleanup(iss.Close)
+    p := oidc.New(oidc.Config{Issuer: iss.URL, ClientID: "web-client", ClientSecret: "s3cret", RedirectURL: "http://app.test/oidc/callback"})
+    return iss, p
+}
+
+// authorize follows the authorization URL and returns the code and state
+// handed back to the redirect URL.
+func authorize(t *testing.T, authURL string) (string, string) {
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+    resp, err := client.Get(authURL)
+    require.NoError(t, err)
+    resp.Body.Close()
+    require.Equal(t, http.StatusFound, resp.StatusCode)
+    loc, err := url.Parse(resp.Header.Get("Location"))
+    require.NoError(t, err)
+    require.Equal(t, "app.test", loc.Host)
+    return loc.Query().Get("code"), loc.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlowWithPKCE(t *testing.T) {
+    iss, p := newProvider(t)
+    iss.SignInAs(oidctest.User{Subject: "u-1", Email: "a@example.com", EmailVerified: true, Name: "A"})
+    ctx := context.Background()
+
+    verifier, challenge, err := oidc.PKCE()
+    require.NoError(t, err)
+    authURL, err := p.AuthURL(ctx, "state-1", "nonce-1", challenge)
+    require.NoError(t, err)
+    code, state := authorize(t, authURL)
+    require.Equal(t, "state-1", state)
+
+    // the wrong verifier is refused by the issuer
+    _, err = p.Exchange(ctx, code, "not-the-verifier", "nonce-1")
+    require.ErrorIs(t, err, oidc.ErrExchange)
+
+    code, _ = authorize(t, authURL)
+    claims, err := p.Exchange(ctx, code, verifier, "nonce-1")
+    require.NoError(t, err)
+    require.Equal(t, "u-1", claims.Subject)
+    require.Equal(t, "a@example.com", claims.Email)
+    require.True(t, claims.EmailVerified)
+
+    // codes are single use
+    _, err = p.Exchange(ctx, code, verifier, "nonce-1")
+    require.ErrorIs(t, err, oidc.ErrExchange)
+}
+
+func TestVerifyRejectsBadTokens(t *testing.T) {
+    iss, p := newProvider(t)
+    ctx := context.Background()
+    now := time.Now()
+    base := func() map[string]any {
+        return map[string]any{"iss": iss.URL, "sub": "u-1", "aud": "web-client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": "n"}
+    }
+    good, err := iss.Sign(base())
+    require.NoError(t, err)
+    _, err = p.Verify(ctx, good, "n")
+    require.NoError(t, err)
+    _, err = p.Verify(ctx, good, "other-nonce")
+    require.ErrorIs(t, err, oidc.ErrInvalidToken)
+
+    for name, change := range map[string]func(map[string]any){
+        "issuer":   func(c map[string]any) { c["iss"] = "https://evil.example" },
+        "audience": func(c map[string]any) { c["aud"] = []string{"someone-else"} },
+        "expired":  func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() },
+        "future":   func(c map[string]any) { c["iat"] = now.Add(time.Hour).Unix() },
+        "subject":  func(c map[string]any) { delete(c, "sub") },
+    } {
+        claims := base()
+        change(claims)
+        raw, err := iss.Sign(claims)
+        require.NoError(t, err)
+        _, err = p.Verify(ctx, raw, "n")
+        require.ErrorIs(t, err, oidc.ErrInvalidToken, name)
+    }
+
+    // multiple audiences need azp
+    claims := base()
+    claims["aud"] = []string{"web-client", "api"}
+    raw, _ := iss.Sign(claims)
+    _, err = p.Verify(ctx, raw, "n")
+    require.ErrorIs(t, err, oidc.ErrInvalidToken)
+    claims["azp"] = "web-client"
+    raw, _ = iss.Sign(claims)
+    _, err = p.Verify(ctx, raw, "n")
+    require.NoError(t, err)
+
+    // a token signed by another key, even under the issuer's kid, fails
+    other, err := rsa.GenerateKey(rand.Reader, 2048)
+    require.NoError(t, err)
+    forged, err := oidctest.SignWith(other, iss.KeyID, base())
+    require.NoError(t, err)
+    _, err = p.Verify(ctx, forged, "n")
+    require.ErrorIs(t, err, oidc.ErrInvalidToken)
+    _, err = p.Verify(ctx, "not.a.jwt", "n")
+    require.ErrorIs(t, err, oidc.ErrInvalidToken)
+}
+
+func TestUnknownKidRefreshesKeysAtMostOncePerInterval(t *testing.T) {
+    iss, p := newProvider(t)
+    ctx := context.Background()
+    now := time.Now()
+    claims := map[string]any{"iss": iss.URL, "sub": "u-1", "aud": "web-client", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(), "nonce": "n"}
+    good, err := iss.Sign(claims)
+    require.NoError(t, err)
+    _, err = p.Verify(ctx, good, "n")
+    require.NoError(t, err)
+    require.Equal(t, 1, iss.JWKSFetches())
+
+    for i := 0; i < 5; i++ {
+        raw, err := oidctest.SignWith(iss.Key, fmt.Sprintf("made-up-%d", i), claims)
+        require.NoError(t, err)
+        _, err = p.Verify(ctx, raw, "n")
+        require.ErrorIs(t, err, oidc.ErrInvalidToken)
+    }
+    require.Equal(t, 1, iss.JWKSFetches())
+}
@@ -0,0 +1,193 @@
+// Package oidctest runs an in-process OpenID Connect issuer for tests. It
+// implements discovery, JWKS, an auto-approving authorization endpoint and a
+// token endpoint that enforces PKCE.
+package oidctest
+
+import (
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync"
+    "time"
+)
+
+// User is the identity the authorization endpoint signs in as.
+type User struct {
+    Subject       string
+    Email         string
+    EmailVerified bool
+    Name          string
+}
+
+type grant struct {
+    user        User
+    clientID    string
+    redirectURI string
+    nonce       string
+    challenge   string
+}
+
+type Issuer struct {
+    *httptest.Server
+    ClientID     string
+    ClientSecret string
+    Key          *rsa.PrivateKey
+    KeyID        string
+
+    mu          sync.Mutex
+    user        User
+    grants      map[string]grant
+    jwksFetches int
+}
+
+// NewIssuer starts an issuer that accepts one client. Call Close when done.
+func NewIssuer(clientID, clientSecret string) (*Issuer, error) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return nil, err
+    }
+    iss := &Issuer{ClientID: clientID, ClientSecret: clientSecret, Key: key, KeyID: "test-key", grants: map[string]grant{}}
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", iss.discovery)
+    mux.HandleFunc("/jwks", iss.jwks)
+    mux.HandleFunc("/authorize", iss.authorize)
+    mux.HandleFunc("/token", iss.token)
+    iss.Server = httptest.NewServer(mux)
+    return iss, nil
+}
+
+// SignInAs sets the user that the next authorization requests approve.
+func (iss *Issuer) SignInAs(u User) {
+    iss.mu.Lock()
+    iss.user = u
+    iss.mu.Unlock()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func (iss *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]any{
+        "issuer":                 iss.URL,
+        "authorization_endpoint": iss.URL + "/authorize",
+        "token_endpoint":         iss.URL + "/token",
+        "jwks_uri":               iss.URL + "/jwks",
+        "id_token_signing_alg_values_supported": []string{"RS256"},
+        "code_challenge_methods_supported":      []string{"S256"},
+    })
+}
+
+// JWKSFetches counts the requests served by the JWKS endpoint.
+func (iss *Issuer) JWKSFetches() int {
+    iss.mu.Lock()
+    defer iss.mu.Unlock()
+    return iss.jwksFetches
+}
+
+func (iss *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+    iss.mu.Lock()
+    iss.jwksFetches++
+    iss.mu.Unlock()
+    pub := iss.Key.PublicKey
+    writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+        "kty": "RSA", "use": "sig", "alg": "RS256", "kid": iss.KeyID,
+        "n": base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+        "e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+    }}})
+}
+
+// authorize approves the request as the current user and redirects back
+// with a code, as a provider would after the user consents.
+func (iss *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    if q.Get("client_id") != iss.ClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+        http.Error(w, "invalid_request", http.StatusBadRequest)
+        return
+    }
+    code := randomString()
+    iss.mu.Lock()
+    iss.grants[code] = grant{user: iss.user, clientID: iss.ClientID, redirectURI: q.Get("redirect_uri"), nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+    iss.mu.Unlock()
+    back, err := url.Parse(q.Get("redirect_uri"))
+    if err != nil {
+        http.Error(w, "invalid_request", http.StatusBadRequest)
+        return
+    }
+    bq := back.Query()
+    bq.Set("code", code)
+    bq.Set("state", q.Get("state"))
+    back.RawQuery = bq.Encode()
+    http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (iss *Issuer) token(w http.ResponseWriter, r *http.Request) {
+    id, secret, ok := r.BasicAuth()
+    if ok {
+        id, _ = url.QueryUnescape(id)
+        secret, _ = url.QueryUnescape(secret)
+    } else {
+        id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+    }
+    if id != iss.ClientID || secret != iss.ClientSecret {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+        return
+    }
+    code := r.PostFormValue("code")
+    iss.mu.Lock()
+    g, found := iss.grants[code]
+    delete(iss.grants, code)
+    iss.mu.Unlock()
+    sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+    if r.PostFormValue("grant_type") != "authorization_code" || !found || g.redirectURI != r.PostFormValue("redirect_uri") ||
+        base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+        return
+    }
+    now := time.Now()
+    idToken, err := iss.Sign(map[string]any{
+        "iss": iss.URL, "sub": g.user.Subject, "aud": g.clientID, "iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+        "nonce": g.nonce, "email": g.user.Email, "email_verified": g.user.EmailVerified, "name": g.user.Name,
+    })
+    if err != nil {
+        writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"access_token": randomString(), "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+// Sign returns claims as an RS256 JWT signed with the issuer's key.
+func (iss *Issuer) Sign(claims map[string]any) (string, error) {
+    return SignWith(iss.Key, iss.KeyID, claims)
+}
+
+// SignWith signs claims with an arbitrary key, e.g. to forge tokens.
+func SignWith(key *rsa.PrivateKey, kid string, claims map[string]any) (string, error) {
+    header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+    signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+    digest := sha256.Sum256([]byte(signing))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+    if err != nil {
+        return "", err
+    }
+    return signing + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func randomString() string {
+    var b [16]byte
+    rand.Read(b[:])
+    return base64.RawURLEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,344 @@
+// Package orders turns preorders into orders and moves them through their
+// lifecycle:
+//
+//	pending_payment → paid → ticketed → refunded | changed | canceled
+//	pending_payment → canceled
+//	paid → refunded
+//
+// Refunded, changed and canceled are final. Reaching one of them gives the
+// order's seats back to inventory; until then they stay taken, exactly as
+// they were while the preorder held them. An order not paid within
+// PaymentWindow is canceled by ExpireUnpaid.
+package orders
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// PaymentWindow is how long a new order waits for payment.
+const PaymentWindow = 30 * time.Minute
+
+// Status is a value of order_status_enum.
+type Status string
+
+const (
+    PendingPayment Status = "pending_payment"
+    Paid           Status = "paid"
+    Ticketed       Status = "ticketed"
+    Refunded       Status = "refunded"
+    Changed        Status = "changed"
+    Canceled       Status = "canceled"
+)
+
+// transitions lists the statuses each status may move to. Final statuses
+// have no entry.
+var transitions = map[Status][]Status{
+    PendingPayment: {Paid, Canceled},
+    Paid:           {Ticketed, Refunded},
+    Ticketed:       {Refunded, Changed, Canceled},
+}
+
+// Valid reports whether s is a known status.
+func (s Status) Valid() bool {
+    switch s {
+    case PendingPayment, Paid, Ticketed, Refunded, Changed, Canceled:
+        return true
+    }
+    return false
+}
+
+// Final reports whether no further transition is possible from s.
+func (s Status) Final() bool {
+    return s.Valid() && len(transitions[s]) == 0
+}
+
+// CanTransition reports whether an order may move from one status to another.
+func CanTransition(from, to Status) bool {
+    for _, next := range transitions[from] {
+        if next == to {
+            return true
+        }
+    }
+    return false
+}
+
+var (
+    ErrNotFound          = errors.New("order not found")
+    ErrPreorderNotFound  = errors.New("preorder not found")
+    ErrPreorderNotActive = errors.New("preorder is no longer active")
+)
+
+// TransitionError is returned for a status change the state machine forbids.
+type TransitionError struct {
+    From, To Status
+}
+
+func (e *TransitionError) Error() string {
+    return fmt.Sprintf("order cannot move from %s to %s", e.From, e.To)
+}
+
+type Order struct {
+    ID         string    `json:"id"`
+    PreorderID *string   `json:"preorderId"`
+    Status     Status    `json:"status"`
+    TotalCents int       `json:"totalCents"`
+    Currency   string    `json:"currency"`
+    CreatedAt  time.Time `json:"createdAt"`
+    UpdatedAt  time.Time `json:"updatedAt"`
+    // ExpiresAt is the payment deadline; it only matters while the order
+    // is pending_payment.
+    ExpiresAt time.Time `json:"expiresAt"`
+    Items     []Item    `json:"items" gorm:"-"`
+}
+
+// Item is one seat of an order.
+type Item struct {
+    ID             int64   `json:"id"`
+    OrderID        string  `json:"-"`
+    TrainNo        string  `json:"trainNo"`
+    ServiceDate    string  `json:"serviceDate"`
+    FromStationID  string  `json:"fromStationId"`
+    ToStationID    string  `json:"toStationId"`
+    SeatType       string  `json:"seatType"`
+    TicketType     string  `json:"ticketType"`
+    PassengerName  *string `json:"passengerName"`
+    DocumentType   *string `json:"documentType"`
+    DocumentNumber *string `json:"documentNumber"`
+    PriceCents     int     `json:"priceCents"`
+}
+
+// traveller is the part of an order item copied from preorder_passengers,
+// with the fare for its ticket type.
+type traveller struct {
+    Name           *string
+    DocumentType   *string
+    DocumentNumber *string
+    TicketType     string
+    PriceCents     int
+}
+
+type Service struct {
+    DB *gorm.DB
+}
+
+func New(db *gorm.DB) *Service {
+    return &Service{DB: db}
+}
+
+// CreateFromPreorder confirms an active, unexpired preorder of userID. The
+// preorder becomes "converted", which the release trigger ignores, so its
+// seats pass to the order without returning to inventory.
+func (s *Service) CreateFromPreorder(ctx context.Context, userID, preorderID string) (Order, error) {
+    var id string
+    err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        var p struct {
+            ID             string
+            TrainServiceID int64
+            SegmentID      int64
+            FromStationID  string
+            ToStationID    string
+            SeatType       string
+            HoldQuantity   int
+            Live           bool
+        }
+        if err := tx.Raw(`SELECT id, train_service_id, segment_id, from_station_id, to_station_id, seat_type::text AS seat_type, hold_quantity,
+                                 status = 'active' AND expires_at > now() AS live
+                          FROM preorders WHERE id::text = ? AND user_id = ? FOR UPDATE`, preorderID, userID).Scan(&p).Error; err != nil {
+            return err
+        }
+        if p.ID == "" {
+            return ErrPreorderNotFound
+        }
+        if !p.Live {
+            return ErrPreorderNotActive
+        }
+        var fare struct {
+            PriceCents  int
+            Currency    string
+            TrainNo     string
+            ServiceDate time.Time
+        }
+        if err := tx.Raw(`SELECT inv.price_cents, inv.currency, ts.train_no, ts.service_date
+                          FROM segment_seat_inventory inv JOIN train_services ts ON ts.id = inv.train_service_id
+                          WHERE inv.segment_id = ? AND inv.seat_type = ?`, p.SegmentID, p.SeatType).Scan(&fare).Error; err != nil {
+            return err
+        }
+        var travellers []traveller
+        if err := tx.Raw(`SELECT name, document_type::text AS document_type, document_number, ticket_type::text AS ticket_type,
+                                 ticket_price_cents(?, ticket_type) AS price_cents
+                          FROM preorder_passengers WHERE preorder_id = ? ORDER BY id`, fare.PriceCents, p.ID).Scan(&travellers).Error; err != nil {
+            return err
+        }
+        // preorders made without passengers hold anonymous adult seats
+        for len(travellers) < p.HoldQuantity {
+            travellers = append(travellers, traveller{TicketType: "adult", PriceCents: fare.PriceCents})
+        }
+        total := 0
+        for _, t := range travellers {
+            total += t.PriceCents
+        }
+
+        if err := tx.Exec("UPDATE preorders SET status = 'converted' WHERE id = ?", p.ID).Error; err != nil {
+            return err
+        }
+        if err := tx.Raw(`INSERT INTO orders(user_id, preorder_id, total_cents, currency, expires_at) VALUES (?, ?, ?, ?, ?) RETURNING id`,
+            userID, p.ID, total, fare.Currency, time.Now().Add(PaymentWindow)).Scan(&id).Error; err != nil {
+            return err
+        }
+        for _, t := range travellers {
+            if err := tx.Exec(`INSERT INTO order_items(order_id, train_service_id, segment_id, train_no, service_date, from_station_id, to_station_id,
+                                                       seat_type, ticket_type, passenger_name, document_type, document_number, price_cents)
+                               VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+                id, p.TrainServiceID, p.SegmentID, fare.TrainNo, fare.ServiceDate, p.FromStationID, p.ToStationID,
+                p.SeatType, t.TicketType, t.Name, t.DocumentType, t.DocumentNumber, t.PriceCents).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return Order{}, err
+    }
+    return s.Get(ctx, userID, id)
+}
+
+// Get returns an order of userID with its items.
+func (s *Service) Get(ctx context.Context, userID, id string) (Order, error) {
+    list, err := s.load(ctx, "user_id = ? AND id::text = ?", userID, id)
+    if err != nil {
+        return Order{}, err
+    }
+    if len(list) == 0 {
+        return Order{}, ErrNotFound
+    }
+    return list[0], nil
+}
+
+// List returns every order of userID, oldest first.
+func (s *Service) List(ctx context.Context, userID string) ([]Order, error) {
+    return s.load(ctx, "user_id = ?", userID)
+}
+
+func (s *Service) load(ctx context.Context, where string, args ...any) ([]Order, error) {
+    db := s.DB.WithContext(ctx)
+    list := []Order{}
+    if err := db.Raw(`SELECT id, preorder_id, status::text AS status, total_cents, currency, created_at, updated_at, expires_at
+                      FROM orders WHERE `+where+` ORDER BY created_at`, args...).Scan(&list).Error; err != nil {
+        return nil, err
+    }
+    if len(list) == 0 {
+        return list, nil
+    }
+    ids := make([]string, len(list))
+    for i, o := range list {
+        ids[i] = o.ID
+    }
+    var items []Item
+    if err := db.Raw(`SELECT id, order_id, train_no, to_char(service_date, 'YYYY-MM-DD') AS service_date, from_station_id, to_station_id,
+                             seat_type::text AS seat_type, ticket_type::text AS ticket_type, passenger_name,
+                             document_type::text AS document_type, document_number, price_cents
+                      FROM order_items WHERE order_id IN ? ORDER BY id`, ids).Scan(&items).Error; err != nil {
+        return nil, err
+    }
+    byOrder := map[string][]Item{}
+    for _, it := range items {
+        byOrder[it.OrderID] = append(byOrder[it.OrderID], it)
+    }
+    for i := range list {
+        list[i].Items = byOrder[list[i].ID]
+        if list[i].Items == nil {
+            list[i].Items = []Item{}
+        }
+    }
+    return list, nil
+}
+
+// Transition moves an order of userID to status to, or returns a
+// *TransitionError if the state machine does not allow it.
+func (s *Service) Transition(ctx context.Context, userID, id string, to Status) (Order, error) {
+    err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        return transition(tx, userID, id, to)
+    })
+    if err != nil {
+        return Order{}, err
+    }
+    return s.Get(ctx, userID, id)
+}
+
+// CancelPending cancels every unpaid order of userID, returning their seats.
+func (s *Service) CancelPending(ctx context.Context, userID string) error {
+    return s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        var ids []string
+        if err := tx.Raw("SELECT id FROM orders WHERE user_id = ? AND status = ?", userID, string(PendingPayment)).Scan(&ids).Error; err != nil {
+            return err
+        }
+        for _, id := range ids {
+            if err := transition(tx, userID, id, Canceled); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// ExpireUnpaid cancels up to limit pending_payment orders past their
+// payment deadline through the same transition as Transition, so their
+// seats are released. Rows locked by another instance are skipped. It
+// returns the number of orders canceled and seats released.
+func (s *Service) ExpireUnpaid(ctx context.Context, limit int) (int64, int64, error) {
+    var n, seats int64
+    err := s.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+        var due []struct {
+            ID     string
+            UserID string
+            Seats  int64
+        }
+        if err := tx.Raw(`SELECT o.id, o.user_id,
+                                 (SELECT count(*) FROM order_items i WHERE i.order_id = o.id AND i.segment_id IS NOT NULL) AS seats
+                          FROM orders o WHERE o.status = ? AND o.expires_at <= now()
+                          ORDER BY o.expires_at LIMIT ? FOR UPDATE SKIP LOCKED`, string(PendingPayment), limit).Scan(&due).Error; err != nil {
+            return err
+        }
+        for _, o := range due {
+            if err := transition(tx, o.UserID, o.ID, Canceled); err != nil {
+                return err
+            }
+            n++
+            seats += o.Seats
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, 0, err
+    }
+    return n, seats, nil
+}
+
+func transition(tx *gorm.DB, userID, id string, to Status) error {
+    var cur string
+    if err := tx.Raw("SELECT status::text FROM orders WHERE id::text = ? AND user_id = ? FOR UPDATE", id, userID).Scan(&cur).Error; err != nil {
+        return err
+    }
+    if cur == "" {
+        return ErrNotFound
+    }
+    if !CanTransition(Status(cur), to) {
+        return &TransitionError{From: Status(cur), To: to}
+    }
+    if err := tx.Exec("UPDATE orders SET status = ?, updated_at = now() WHERE id = ?", string(to), id).Error; err != nil {
+        return err
+    }
+    if !to.Final() {
+        return nil
+    }
+    // seats of services that have left the rolling window are gone already
+    return tx.Exec(`UPDATE segment_seat_inventory inv SET left_seats = inv.left_seats + n.seats
+                    FROM (SELECT segment_id, seat_type, count(*) AS seats FROM order_items
+                          WHERE order_id = ? AND segment_id IS NOT NULL GROUP BY segment_id, seat_type) n
+                    WHERE inv.segment_id = n.segment_id AND inv.seat_type = n.seat_type`, id).Error
+}
@@ -0,0 +1,127 @@
+package orders
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "cs3604/backend/internal/config"
+    "cs3604/backend/internal/db"
+    "cs3604/backend/internal/repo"
+    "github.com/stretchr/testify/require"
+)
+
+func TestCanTransition(t *testing.T) {
+    all := []Status{PendingPayment, Paid, Ticketed, Refunded, Changed, Canceled}
+    legal := map[[2]Status]bool{
+        {PendingPayment, Paid}:     true,
+        {PendingPayment, Canceled}: true,
+        {Paid, Ticketed}:           true,
+        {Paid, Refunded}:           true,
+        {Ticketed, Refunded}:       true,
+        {Ticketed, Changed}:        true,
+        {Ticketed, Canceled}:       true,
+    }
+    for _, from := range all {
+        for _, to := range all {
+            if got := CanTransition(from, to); got != legal[[2]Status{from, to}] {
+                t.Errorf("CanTransition(%s, %s) = %v", from, to, got)
+            }
+        }
+    }
+}
+
+func TestFinal(t *testing.T) {
+    for _, c := range []struct {
+        status Status
+        final  bool
+    }{
+        {PendingPayment, false},
+        {Paid, false},
+        {Ticketed, false},
+        {Refunded, true},
+        {Changed, true},
+        {Canceled, true},
+        {"shipped", false},
+    } {
+        if got := c.status.Final(); got != c.final {
+            t.Errorf("%s.Final() = %v, want %v", c.status, got, c.final)
+        }
+    }
+}
+
+func TestTransitionError(t *testing.T) {
+    err := &TransitionError{From: Canceled, To: Paid}
+    if err.Error() != "order cannot move from canceled to paid" {
+        t.Fatalf("unexpected message %q", err.Error())
+    }
+}
+
+func TestCreateFromPreorderAndTransition(t *testing.T) {
+    gdb, err := db.Open(config.LoadDB().DSN())
+    require.NoError(t, err)
+    r := repo.New(gdb)
+
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    require.Len(t, sts, 2)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else { shh = s.ID } }
+    // a train and date no other test books, so the seat counts are this test's alone
+    svcID, segID, err := r.ServiceAndSegment("G2", time.Now().AddDate(0, 0, 2), bjp, shh)
+    require.NoError(t, err)
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    var base int
+    require.NoError(t, gdb.Raw("SELECT price_cents FROM segment_seat_inventory WHERE segment_id = ? AND seat_type = 'second'", segID).Scan(&base).Error)
+
+    uid, err := r.CreateUser("test_user_orders", "test_user_orders@example.com", "dummyhash")
+    require.NoError(t, err)
+    defer r.DeleteUser(uid)
+
+    // two seats, one of them for a named child
+    pid, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 2, time.Now().Add(10*time.Minute))
+    require.NoError(t, err)
+    require.NoError(t, gdb.Exec(`INSERT INTO preorder_passengers(preorder_id, name, document_type, document_number, ticket_type)
+                                 VALUES (?, 'Li Xiaoming', 'passport', 'E00000021', 'child')`, pid).Error)
+
+    s := New(gdb)
+    ctx := context.Background()
+    o, err := s.CreateFromPreorder(ctx, uid, pid)
+    require.NoError(t, err)
+    require.Equal(t, PendingPayment, o.Status)
+    require.Len(t, o.Items, 2)
+    // the child pays half; the seat held without a passenger is an adult's
+    require.Equal(t, "child", o.Items[0].TicketType)
+    require.Equal(t, (base+1)/2, o.Items[0].PriceCents)
+    require.Equal(t, "adult", o.Items[1].TicketType)
+    require.Equal(t, base, o.Items[1].PriceCents)
+    require.Equal(t, o.Items[0].PriceCents+o.Items[1].PriceCents, o.TotalCents)
+    _, err = s.CreateFromPreorder(ctx, uid, pid)
+    require.ErrorIs(t, err, ErrPreorderNotActive)
+
+    _, err = s.Transition(ctx, uid, o.ID, Ticketed)
+    var terr *TransitionError
+    require.ErrorAs(t, err, &terr)
+    require.Equal(t, PendingPayment, terr.From)
+    for _, to := range []Status{Paid, Ticketed} {
+        o, err = s.Transition(ctx, uid, o.ID, to)
+        require.NoError(t, err)
+        require.Equal(t, to, o.Status)
+    }
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-2, left)
+
+    // canceling a ticketed order gives its seats back, and is final
+    o, err = s.Transition(ctx, uid, o.ID, Canceled)
+    require.NoError(t, err)
+    require.Equal(t, Canceled, o.Status)
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore, left)
+    _, err = s.Transition(ctx, uid, o.ID, Refunded)
+    require.ErrorAs(t, err, &terr)
+    _, err = s.Transition(ctx, uid, "00000000-0000-0000-0000-000000000000", Paid)
+    require.ErrorIs(t, err, ErrNotFound)
+}
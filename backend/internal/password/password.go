@@ -0,0 +1,136 @@
+// Package password hashes and verifies user passwords under a configurable
+// policy. Hashes are stored in their self-describing encoded form (bcrypt's
+// "$2a$..." or the PHC "$argon2id$..." string) so that several algorithms
+// and cost settings can coexist in the users table.
+package password
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "strings"
+
+    "cs3604/backend/internal/config"
+
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+)
+
+const (
+    Bcrypt   = "bcrypt"
+    Argon2id = "argon2id"
+)
+
+var ErrUnknownFormat = errors.New("password: unknown hash format")
+
+// Hasher hashes new passwords with the current policy and verifies stored
+// hashes of any supported format.
+type Hasher interface {
+    Hash(password string) (string, error)
+    // Verify reports whether password matches encoded, and whether encoded
+    // was produced with weaker or different settings than the current policy
+    // and should be replaced after a successful check.
+    Verify(password, encoded string) (match bool, rehash bool)
+}
+
+// Argon2Params are the RFC 9106 tuning knobs.
+type Argon2Params struct {
+    Memory  uint32 // KiB
+    Time    uint32
+    Threads uint8
+    SaltLen uint32
+    KeyLen  uint32
+}
+
+type policy struct {
+    algorithm  string
+    bcryptCost int
+    argon2     Argon2Params
+}
+
+// New returns the Hasher for cfg, falling back to bcrypt for unknown algorithms.
+func New(cfg config.PasswordConfig) Hasher {
+    p := &policy{
+        algorithm:  cfg.Algorithm,
+        bcryptCost: cfg.BcryptCost,
+        argon2:     Argon2Params{Memory: cfg.Argon2Memory, Time: cfg.Argon2Time, Threads: cfg.Argon2Threads, SaltLen: 16, KeyLen: 32},
+    }
+    if p.algorithm != Argon2id {
+        p.algorithm = Bcrypt
+    }
+    if p.bcryptCost < bcrypt.MinCost || p.bcryptCost > bcrypt.MaxCost {
+        p.bcryptCost = bcrypt.DefaultCost
+    }
+    return p
+}
+
+func (p *policy) Hash(password string) (string, error) {
+    if p.algorithm == Argon2id {
+        return hashArgon2id(password, p.argon2)
+    }
+    b, err := bcrypt.GenerateFromPassword([]byte(password), p.bcryptCost)
+    return string(b), err
+}
+
+func (p *policy) Verify(password, encoded string) (bool, bool) {
+    if strings.HasPrefix(encoded, "$argon2id$") {
+        params, salt, key, err := decodeArgon2id(encoded)
+        if err != nil {
+            return false, false
+        }
+        got := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+        if subtle.ConstantTimeCompare(got, key) != 1 {
+            return false, false
+        }
+        want := p.argon2
+        return true, p.algorithm != Argon2id || params.Memory != want.Memory || params.Time != want.Time || params.Threads != want.Threads
+    }
+    if bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)) != nil {
+        return false, false
+    }
+    cost, err := bcrypt.Cost([]byte(encoded))
+    return true, err != nil || p.algorithm != Bcrypt || cost < p.bcryptCost
+}
+
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+    salt := make([]byte, params.SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+    b64 := base64.RawStdEncoding
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2.Version, params.Memory, params.Time, params.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// decodeArgon2id parses "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+    var params Argon2Params
+    parts := strings.Split(encoded, "$")
+    if len(parts) != 6 {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    b64 := base64.RawStdEncoding
+    salt, err := b64.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    key, err := b64.DecodeString(parts[5])
+    if err != nil {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    if len(salt) == 0 || len(key) == 0 || params.Time == 0 || params.Threads == 0 || params.Memory < 8*uint32(params.Threads) {
+        return params, nil, nil, ErrUnknownFormat
+    }
+    params.SaltLen, params.KeyLen = uint32(len(salt)), uint32(len(key))
+    return params, salt, key, nil
+}
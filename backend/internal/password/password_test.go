@@ -0,0 +1,64 @@
+package password
+
+import (
+    "strings"
+    "testing"
+
+    "cs3604/backend/internal/config"
+    "github.com/stretchr/testify/require"
+)
+
+func testConfig(algorithm string, cost int) config.PasswordConfig {
+    return config.PasswordConfig{Algorithm: algorithm, BcryptCost: cost, Argon2Memory: 8 * 1024, Argon2Time: 1, Argon2Threads: 1}
+}
+
+func TestHashAndVerify(t *testing.T) {
+    for _, algo := range []string{Bcrypt, Argon2id} {
+        h := New(testConfig(algo, 4))
+        enc, err := h.Hash("Passw0rd!")
+        require.NoError(t, err)
+        require.True(t, strings.HasPrefix(enc, map[string]string{Bcrypt: "$2a$", Argon2id: "$argon2id$"}[algo]))
+        match, rehash := h.Verify("Passw0rd!", enc)
+        require.True(t, match, algo)
+        require.False(t, rehash, algo)
+        match, _ = h.Verify("wrong", enc)
+        require.False(t, match, algo)
+    }
+}
+
+func TestVerify_FlagsOutdatedHashes(t *testing.T) {
+    weak, err := New(testConfig(Bcrypt, 4)).Hash("Passw0rd!")
+    require.NoError(t, err)
+
+    // higher bcrypt cost
+    match, rehash := New(testConfig(Bcrypt, 5)).Verify("Passw0rd!", weak)
+    require.True(t, match)
+    require.True(t, rehash)
+
+    // switched algorithm
+    match, rehash = New(testConfig(Argon2id, 4)).Verify("Passw0rd!", weak)
+    require.True(t, match)
+    require.True(t, rehash)
+
+    // changed argon2 parameters
+    argon, err := New(testConfig(Argon2id, 4)).Hash("Passw0rd!")
+    require.NoError(t, err)
+    stronger := testConfig(Argon2id, 4)
+    stronger.Argon2Time = 2
+    match, rehash = New(stronger).Verify("Passw0rd!", argon)
+    require.True(t, match)
+    require.True(t, rehash)
+
+    // a wrong password never asks for a rehash
+    match, rehash = New(stronger).Verify("nope", argon)
+    require.False(t, match)
+    require.False(t, rehash)
+}
+
+func TestVerify_RejectsGarbage(t *testing.T) {
+    h := New(testConfig(Argon2id, 4))
+    for _, enc := range []string{"", "dummyhash", "$argon2id$v=19$m=1,t=1,p=1$$", "$argon2id$v=18$m=8192,t=1,p=1$c2FsdA$a2V5"} {
+        match, _ := h.Verify("x", enc)
+        require.False(t, match, enc)
+    }
+}
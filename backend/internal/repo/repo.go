@@ -59,11 +59,11 @@ func (r *Repo) InventoryLeft(segmentID int64, seatType string) (int, error) {
     return left, err
 }
 
-// Create preorder (hold 1 seat) and return id
-func (r *Repo) CreatePreorder(userID string, svcID, segID int64, fromID, toID, seatType string, expires time.Time) (string, error) {
+// Create preorder holding quantity seats and return id
+func (r *Repo) CreatePreorder(userID string, svcID, segID int64, fromID, toID, seatType string, quantity int, expires time.Time) (string, error) {
     var id string
     err := r.DB.Raw(`INSERT INTO preorders(user_id,train_service_id,from_station_id,to_station_id,segment_id,seat_type,hold_quantity,expires_at)
-                    VALUES (?,?,?,?,?,?,1,?) RETURNING id`, userID, svcID, fromID, toID, segID, seatType, expires).Scan(&id).Error
+                    VALUES (?,?,?,?,?,?,?,?) RETURNING id`, userID, svcID, fromID, toID, segID, seatType, quantity, expires).Scan(&id).Error
     return id, err
 }
 
@@ -138,4 +138,12 @@ func (r *Repo) SearchView(fromID, toID string, date time.Time, departStart, depa
     var items []TrainSearchItem
     res := r.DB.Raw(sql, args...).Scan(&items)
     return items, res.Error
-}
\ No newline at end of file
+}
+
+// SetUserRole sets the role of the live account whose username or email is
+// identifier and reports how many accounts matched.
+func (r *Repo) SetUserRole(identifier, role string) (int64, error) {
+    res := r.DB.Exec(`UPDATE users SET role = CAST(? AS user_role_enum), updated_at = now()
+                      WHERE (username = ? OR email = ?) AND deleted_at IS NULL`, role, identifier, identifier)
+    return res.RowsAffected, res.Error
+}
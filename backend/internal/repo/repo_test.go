@@ -46,7 +46,7 @@ func TestRepoDatabaseFeatures(t *testing.T) {
     require.NoError(t, err)
     defer r.DeleteUser(uid)
 
-    pid, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", time.Now().Add(10*time.Minute))
+    pid, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 1, time.Now().Add(10*time.Minute))
     require.NoError(t, err)
     require.NotEmpty(t, pid)
     leftAfter, err := r.InventoryLeft(segID, "second")
@@ -59,6 +59,22 @@ func TestRepoDatabaseFeatures(t *testing.T) {
     require.NoError(t, err)
     require.Equal(t, leftBefore, leftFinal)
 
+    // a group hold takes all of its seats or none
+    pid, err = r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 3, time.Now().Add(10*time.Minute))
+    require.NoError(t, err)
+    leftAfter, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-3, leftAfter)
+    _, err = r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", leftAfter+1, time.Now().Add(10*time.Minute))
+    require.Error(t, err)
+    leftFinal, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftAfter, leftFinal)
+    require.NoError(t, r.UpdatePreorderStatus(pid, "canceled"))
+    leftFinal, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore, leftFinal)
+
     err = r.InsertTrainService("D5", time.Now().Add(20*24*time.Hour))
     require.Error(t, err)
 }
\ No newline at end of file
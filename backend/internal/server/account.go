@@ -0,0 +1,188 @@
+package server
+
+import (
+    "net/http"
+    "time"
+
+    "cs3604/backend/internal/orders"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// statusDeleted marks an anonymized account; the row stays so that preorders
+// keep their owner for accounting.
+const statusDeleted = "deleted"
+
+type deleteAccountRequest struct {
+    Password string `json:"password"`
+    // Code or RecoveryCode is required when two-factor login is enabled.
+    Code         string `json:"code"`
+    RecoveryCode string `json:"recoveryCode"`
+}
+
+func (s *Server) accountRoutes(g *gin.RouterGroup) {
+    g.DELETE("/users/me", s.RequireSession(), s.deleteAccount)
+    g.GET("/users/me/export", s.RequireSession(), s.exportAccount)
+}
+
+// deleteAccount re-authenticates the user, then strips every piece of
+// personal data from the account and signs it out everywhere. Booking rows
+// are kept; active holds and unpaid orders are released.
+func (s *Server) deleteAccount(c *gin.Context) {
+    user := currentUser(c)
+    var req deleteAccountRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var hash string
+    s.DB.Raw("SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&hash)
+    if !s.checkPassword(user.ID, hash, req.Password) {
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
+        return
+    }
+    twoFactor := s.totpEnabled(user.ID)
+    verified := true
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        if twoFactor {
+            var err error
+            if verified, err = verifySecondFactor(tx, user.ID, req.Code, req.RecoveryCode); err != nil || !verified {
+                return err
+            }
+        }
+        // the placeholder username is longer than registration allows, so it can never be taken
+        if err := tx.Exec(`UPDATE users SET username = 'deleted_' || replace(id::text, '-', ''), email = NULL, mobile = NULL,
+                                  password_hash = '!', name = NULL, nationality = NULL, passport_number = NULL,
+                                  passport_expiration_date = NULL, date_of_birth = NULL, gender = NULL,
+                                  status = ?, deleted_at = now(), updated_at = now()
+                           WHERE id = ?`, statusDeleted, user.ID).Error; err != nil {
+            return err
+        }
+        if err := orders.New(tx).CancelPending(c.Request.Context(), user.ID); err != nil {
+            return err
+        }
+        steps := []string{
+            "UPDATE preorders SET status = 'canceled' WHERE user_id = ? AND status = 'active'",
+            "DELETE FROM preorder_passengers WHERE preorder_id IN (SELECT id FROM preorders WHERE user_id = ?)",
+            `UPDATE order_items SET passenger_name = NULL, document_type = NULL, document_number = NULL
+             WHERE order_id IN (SELECT id FROM orders WHERE user_id = ?)`,
+            "UPDATE sessions SET revoked_at = COALESCE(revoked_at, now()), user_agent = NULL, ip = NULL WHERE user_id = ?",
+            "UPDATE api_tokens SET revoked_at = COALESCE(revoked_at, now()) WHERE user_id = ?",
+            "UPDATE user_tokens SET used_at = COALESCE(used_at, now()), payload = NULL WHERE user_id = ?",
+            "DELETE FROM user_totp WHERE user_id = ?",
+            "DELETE FROM recovery_codes WHERE user_id = ?",
+            "DELETE FROM login_challenges WHERE user_id = ?",
+            "DELETE FROM user_identities WHERE user_id = ?",
+            "DELETE FROM passengers WHERE user_id = ?",
+            "DELETE FROM otp_codes WHERE user_id = ?",
+            // the security audit trail keeps its times and outcomes, but
+            // nothing that identifies the person: login names, addresses
+            // and browsers go, as they do from sessions
+            "UPDATE login_events SET identifier = NULL, ip = NULL, user_agent = NULL WHERE user_id = ?",
+            "UPDATE login_attempts SET identifier = 'deleted_' || replace(user_id::text, '-', ''), ip = NULL WHERE user_id = ?",
+            "DELETE FROM idempotency_keys WHERE user_id = ?",
+        }
+        for _, q := range steps {
+            if err := tx.Exec(q, user.ID).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not delete account"})
+        return
+    }
+    if !verified {
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid or missing two-factor code"})
+        return
+    }
+    s.setCookie(c, "sid", "", -1)
+    c.Status(http.StatusNoContent)
+}
+
+type exportSession struct {
+    CreatedAt  time.Time  `json:"createdAt"`
+    ExpiresAt  time.Time  `json:"expiresAt"`
+    RevokedAt  *time.Time `json:"revokedAt"`
+    RememberMe bool       `json:"rememberMe"`
+    UserAgent  *string    `json:"userAgent"`
+    IP         *string    `json:"ip"`
+}
+
+type exportAPIToken struct {
+    Name       string     `json:"name"`
+    Scopes     string     `json:"scopes"`
+    CreatedAt  time.Time  `json:"createdAt"`
+    ExpiresAt  *time.Time `json:"expiresAt"`
+    LastUsedAt *time.Time `json:"lastUsedAt"`
+    RevokedAt  *time.Time `json:"revokedAt"`
+}
+
+type exportIdentity struct {
+    Issuer      string     `json:"issuer"`
+    Subject     string     `json:"subject"`
+    Email       *string    `json:"email"`
+    CreatedAt   time.Time  `json:"createdAt"`
+    LastLoginAt *time.Time `json:"lastLoginAt"`
+}
+
+// exportAccount returns everything stored about the user as one JSON
+// document, served as a download.
+func (s *Server) exportAccount(c *gin.Context) {
+    user := currentUser(c)
+    p, err := s.loadProfile(user.ID)
+    sessions := []exportSession{}
+    events := []loginEventItem{}
+    tokens := []exportAPIToken{}
+    identities := []exportIdentity{}
+    preorders := []preorderItem{}
+    queries := []struct {
+        dest any
+        sql  string
+    }{
+        {&sessions, `SELECT created_at, expires_at, revoked_at, remember_me, user_agent, host(ip) AS ip
+                     FROM sessions WHERE user_id = ? ORDER BY created_at`},
+        {&events, `SELECT event, outcome, reason, host(ip) AS ip, user_agent, created_at
+                   FROM login_events WHERE user_id = ? ORDER BY created_at, id`},
+        {&tokens, `SELECT name, array_to_string(scopes, ' ') AS scopes, created_at, expires_at, last_used_at, revoked_at
+                   FROM api_tokens WHERE user_id = ? ORDER BY created_at`},
+        {&identities, `SELECT issuer, subject, email, created_at, last_login_at
+                       FROM user_identities WHERE user_id = ? ORDER BY created_at`},
+        {&preorders, preorderSelect + " WHERE p.user_id = ? ORDER BY p.created_at"},
+    }
+    for _, q := range queries {
+        if err != nil {
+            break
+        }
+        err = s.DB.Raw(q.sql, user.ID).Scan(q.dest).Error
+    }
+    var passengers []passengerItem
+    if err == nil {
+        passengers, err = s.loadPassengers(user.ID, "")
+    }
+    if err == nil {
+        err = s.attachPreorderPassengers(preorders)
+    }
+    var userOrders []orders.Order
+    if err == nil {
+        userOrders, err = s.Orders.List(c.Request.Context(), user.ID)
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not export account"})
+        return
+    }
+    c.Header("Content-Disposition", `attachment; filename="12306-account-export.json"`)
+    c.JSON(http.StatusOK, gin.H{
+        "exportedAt":   time.Now().UTC(),
+        "profile":      p,
+        "sessions":     sessions,
+        "loginHistory": events,
+        "apiTokens":    tokens,
+        "identities":   identities,
+        "passengers":   passengers,
+        "preorders":    preorders,
+        "orders":       userOrders,
+    })
+}
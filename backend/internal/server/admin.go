@@ -0,0 +1,143 @@
+package server
+
+import (
+    "expvar"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "sort"
+
+    "cs3604/backend/internal/config"
+    "cs3604/backend/internal/sweeper"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// Values of users.role.
+const (
+    roleCustomer = "customer"
+    roleSupport  = "support"
+    roleAdmin    = "admin"
+)
+
+var validRoles = []string{roleCustomer, roleSupport, roleAdmin}
+
+// seedTables are counted before and after seeding to report what was inserted.
+var seedTables = []string{"stations", "trains", "train_services", "service_segments", "segment_seat_inventory"}
+
+type roleRequest struct {
+    Role string `json:"role"`
+}
+
+func (s *Server) adminRoutes(g *gin.RouterGroup) {
+    admin := g.Group("/admin", s.RequireRole(roleAdmin))
+    admin.POST("/init-seed", s.initSeed)
+    admin.POST("/jobs/rolling14", s.runRolling14)
+    admin.POST("/jobs/expire-preorders", s.runExpirePreorders)
+    admin.GET("/metrics", gin.WrapH(expvar.Handler()))
+    admin.PUT("/users/:id/role", s.setUserRole)
+}
+
+// runRolling14 drops past services and clones today's into the next 13 days.
+func (s *Server) runRolling14(c *gin.Context) {
+    if err := s.DB.Exec("SELECT ensure_rolling_14_days()").Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"job failed"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// runExpirePreorders runs the preorder sweeper now instead of waiting for its
+// next tick; it also cancels unpaid orders past their deadline.
+func (s *Server) runExpirePreorders(c *gin.Context) {
+    res, err := sweeper.New(s.DB, config.LoadSweeper()).Sweep(c.Request.Context())
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"job failed"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"preordersExpired": res.Preorders, "ordersCanceled": res.Orders, "seatsReleased": res.Seats})
+}
+
+// initSeed runs the sample-data scripts from the seed directory (every .sql
+// file except the schema) in one transaction. The scripts are idempotent, so
+// seeding twice reports zero inserts.
+func (s *Server) initSeed(c *gin.Context) {
+    files, err := filepath.Glob(filepath.Join(s.SeedDir, "*.sql"))
+    if err != nil || len(files) == 0 {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"no seed scripts found"})
+        return
+    }
+    sort.Strings(files)
+    count := func(tx *gorm.DB) (map[string]int64, error) {
+        n := map[string]int64{}
+        for _, t := range seedTables {
+            var v int64
+            // table names come from seedTables, never from the request
+            if err := tx.Raw("SELECT count(*) FROM " + t).Scan(&v).Error; err != nil {
+                return nil, err
+            }
+            n[t] = v
+        }
+        return n, nil
+    }
+    inserted := map[string]int64{}
+    ran := []string{}
+    err = s.DB.Transaction(func(tx *gorm.DB) error {
+        before, err := count(tx)
+        if err != nil {
+            return err
+        }
+        for _, f := range files {
+            name := filepath.Base(f)
+            if name == "00-init.sql" {
+                continue
+            }
+            script, err := os.ReadFile(f)
+            if err != nil {
+                return err
+            }
+            if err := tx.Exec(string(script)).Error; err != nil {
+                log.Printf("seed %s: %v", name, err)
+                return err
+            }
+            ran = append(ran, name)
+        }
+        after, err := count(tx)
+        if err != nil {
+            return err
+        }
+        for _, t := range seedTables {
+            inserted[t] = after[t] - before[t]
+        }
+        return nil
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"seeding failed"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"inserted": inserted, "scripts": ran})
+}
+
+func (s *Server) setUserRole(c *gin.Context) {
+    var req roleRequest
+    if err := c.ShouldBindJSON(&req); err != nil || !contains(validRoles, req.Role) {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"role must be one of customer, support, admin"})
+        return
+    }
+    if c.Param("id") == currentUser(c).ID && req.Role != roleAdmin {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"admins cannot demote themselves"})
+        return
+    }
+    res := s.DB.Exec("UPDATE users SET role = CAST(? AS user_role_enum), updated_at = now() WHERE id::text = ? AND deleted_at IS NULL", req.Role, c.Param("id"))
+    if res.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not update role"})
+        return
+    }
+    if res.RowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"user not found"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "role": req.Role})
+}
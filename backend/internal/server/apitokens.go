@@ -0,0 +1,159 @@
+package server
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Scopes grantable to personal access tokens. search covers station and
+// train lookups, booking covers passengers, preorders and orders; a script
+// that does both needs both.
+const (
+    scopeSearch  = "search"
+    scopeBooking = "booking"
+)
+
+var apiTokenScopes = []string{scopeSearch, scopeBooking}
+
+const apiTokenPrefix = "pat_"
+
+type createAPITokenRequest struct {
+    Name          string   `json:"name"`
+    Scopes        []string `json:"scopes"`
+    ExpiresInDays int      `json:"expiresInDays"`
+}
+
+type apiTokenItem struct {
+    ID         string     `json:"id"`
+    Name       string     `json:"name"`
+    Scopes     []string   `json:"scopes" gorm:"-"`
+    ScopeList  string     `json:"-"`
+    ExpiresAt  *time.Time `json:"expiresAt"`
+    LastUsedAt *time.Time `json:"lastUsedAt"`
+    CreatedAt  time.Time  `json:"createdAt"`
+}
+
+func (s *Server) apiTokenRoutes(g *gin.RouterGroup) {
+    tg := g.Group("/api-tokens", s.RequireSession())
+    tg.GET("", s.listAPITokens)
+    tg.POST("", s.createAPIToken)
+    tg.DELETE("/:id", s.revokeAPIToken)
+}
+
+// resolveAPIToken returns the owner of a live token, touching last_used_at at
+// most once a minute.
+func (s *Server) resolveAPIToken(raw string) *CurrentUser {
+    if !strings.HasPrefix(raw, apiTokenPrefix) {
+        return nil
+    }
+    var row struct {
+        TokenID  string
+        ID       string
+        Username string
+        Email    *string
+        Mobile   *string
+        Role     string
+        Status   string
+        Scopes   string
+    }
+    s.DB.Raw(`SELECT t.id AS token_id, u.id, u.username, u.email, u.mobile, u.role::text AS role, u.status, array_to_string(t.scopes, ',') AS scopes
+              FROM api_tokens t JOIN users u ON u.id = t.user_id
+              WHERE t.token_hash = ? AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > now()) LIMIT 1`,
+        hashToken(raw)).Scan(&row)
+    if row.ID == "" {
+        return nil
+    }
+    s.DB.Exec("UPDATE api_tokens SET last_used_at = now() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')", row.TokenID)
+    return &CurrentUser{ID: row.ID, Username: row.Username, Email: row.Email, Mobile: row.Mobile, Role: row.Role, Status: row.Status,
+        TokenID: row.TokenID, Scopes: strings.Split(row.Scopes, ",")}
+}
+
+func (s *Server) listAPITokens(c *gin.Context) {
+    user := currentUser(c)
+    items := []apiTokenItem{}
+    if err := s.DB.Raw(`SELECT id, name, array_to_string(scopes, ',') AS scope_list, expires_at, last_used_at, created_at
+                        FROM api_tokens WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+                        ORDER BY created_at DESC`, user.ID).Scan(&items).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not list tokens"})
+        return
+    }
+    for i := range items {
+        items[i].Scopes = strings.Split(items[i].ScopeList, ",")
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// createAPIToken returns the plaintext token exactly once; only its hash is kept.
+func (s *Server) createAPIToken(c *gin.Context) {
+    user := currentUser(c)
+    var req createAPITokenRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    details := gin.H{}
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" || len(req.Name) > 100 {
+        details["name"] = "required, at most 100 characters"
+    }
+    if len(req.Scopes) == 0 {
+        details["scopes"] = "at least one scope is required"
+    }
+    for _, sc := range req.Scopes {
+        if !contains(apiTokenScopes, sc) {
+            details["scopes"] = "unknown scope " + sc
+        }
+    }
+    if req.ExpiresInDays < 0 || req.ExpiresInDays > 365 {
+        details["expiresInDays"] = "must be between 0 and 365"
+    }
+    if len(details) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"invalid token request","details": details})
+        return
+    }
+    var expires *time.Time
+    if req.ExpiresInDays > 0 {
+        t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+        expires = &t
+    }
+    raw, _, err := newToken()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create token"})
+        return
+    }
+    raw = apiTokenPrefix + raw
+    var id string
+    if err := s.DB.Raw(`INSERT INTO api_tokens(user_id, name, token_hash, scopes, expires_at)
+                        VALUES (?, ?, ?, string_to_array(?, ','), ?) RETURNING id`,
+        user.ID, req.Name, hashToken(raw), strings.Join(req.Scopes, ","), expires).Scan(&id).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create token"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"id": id, "name": req.Name, "scopes": req.Scopes, "expiresAt": expires, "token": raw})
+}
+
+func (s *Server) revokeAPIToken(c *gin.Context) {
+    user := currentUser(c)
+    res := s.DB.Exec("UPDATE api_tokens SET revoked_at = now() WHERE id::text = ? AND user_id = ? AND revoked_at IS NULL", c.Param("id"), user.ID)
+    if res.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not revoke token"})
+        return
+    }
+    if res.RowsAffected == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"token not found"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+func contains(list []string, v string) bool {
+    for _, x := range list {
+        if x == v {
+            return true
+        }
+    }
+    return false
+}
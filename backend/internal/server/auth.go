@@ -1,11 +1,11 @@
 package server
 
 import (
+    "log"
     "net/http"
     "time"
 
     "github.com/gin-gonic/gin"
-    "golang.org/x/crypto/bcrypt"
 )
 
 type loginRequest struct {
@@ -29,9 +29,16 @@ type registerRequest struct {
 
 func (s *Server) authRoutes(g *gin.RouterGroup) {
     g.POST("/auth/login", s.login)
+    g.GET("/users/me/login-history", s.RequireSession(), s.loginHistory)
     g.POST("/auth/logout", s.logout)
+    g.GET("/auth/csrf", s.RequireSession(), s.csrfToken)
     g.POST("/auth/register", s.register)
-    g.GET("/session/me", s.sessionMe)
+    g.GET("/auth/availability", s.RateLimit(newRateLimiter(availabilityPerMinute, time.Minute)), s.checkAvailability)
+    g.POST("/auth/password/forgot", s.RateLimit(newRateLimiter(forgotPasswordPerHour, time.Hour)), s.forgotPassword)
+    g.POST("/auth/password/reset", s.resetPassword)
+    g.POST("/auth/verify-email", s.verifyEmail)
+    g.POST("/auth/verify-email/resend", s.resendVerification)
+    g.GET("/session/me", s.RequireScope(scopeSearch, scopeBooking), s.sessionMe)
 }
 
 func (s *Server) login(c *gin.Context) {
@@ -40,49 +47,133 @@ func (s *Server) login(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
         return
     }
+    ip := c.ClientIP()
+    if t := s.checkLoginThrottle(req.Identifier, ip); t != nil {
+        s.recordLoginEvent(c, "", req.Identifier, eventLogin, outcomeFailure, t.Code)
+        t.respond(c)
+        return
+    }
     // lookup by username/email/mobile
-    var row struct{ ID string; Username string; Email *string; Mobile *string; PasswordHash string }
-    s.DB.Raw("SELECT id, username, email, mobile, password_hash FROM users WHERE username = ? OR email = ? OR mobile = ? LIMIT 1",
+    var row loginUser
+    s.DB.Raw("SELECT id, username, email, mobile, password_hash, status FROM users WHERE username = ? OR email = ? OR mobile = ? LIMIT 1",
         req.Identifier, req.Identifier, req.Identifier).Scan(&row)
     if row.ID == "" {
+        s.recordLoginAttempt(req.Identifier, ip, "", false)
+        s.recordLoginEvent(c, "", req.Identifier, eventLogin, outcomeFailure, "unknown_user")
         c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
         return
     }
-    if bcrypt.CompareHashAndPassword([]byte(row.PasswordHash), []byte(req.Password)) != nil {
+    if !s.checkPassword(row.ID, row.PasswordHash, req.Password) {
+        s.recordLoginAttempt(req.Identifier, ip, row.ID, false)
+        s.recordLoginEvent(c, row.ID, req.Identifier, eventLogin, outcomeFailure, "invalid_password")
         c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
         return
     }
-    // create session
-    expires := time.Now().Add(7 * 24 * time.Hour)
-    var sid string
-    s.DB.Raw("INSERT INTO sessions(user_id, expires_at) VALUES (?, ?) RETURNING sid", row.ID, expires).Scan(&sid)
-    c.SetCookie("sid", sid, int(expires.Sub(time.Now()).Seconds()), "/", "", false, true)
-    c.JSON(http.StatusOK, gin.H{"user": gin.H{"id": row.ID, "username": row.Username, "email": row.Email, "mobile": row.Mobile}, "session": gin.H{"sid": sid, "expiresAt": expires}})
+    // success is only recorded once the session is issued, so a pending
+    // second factor does not reset the lockout
+    s.completeLogin(c, row, req.Identifier, req.RememberMe, "password")
+}
+
+// loginUser is the users row needed to finish a login.
+type loginUser struct {
+    ID           string
+    Username     string
+    Email        *string
+    Mobile       *string
+    PasswordHash string
+    Status       string
+}
+
+// completeLogin runs the checks shared by every login method once the user
+// has proven who they are, then either creates the session or asks for the
+// second factor.
+func (s *Server) completeLogin(c *gin.Context, row loginUser, identifier string, remember bool, method string) {
+    if row.Status == statusPending {
+        s.recordLoginEvent(c, row.ID, identifier, eventLogin, outcomeFailure, "email_unverified")
+        c.JSON(http.StatusForbidden, gin.H{"code":"email_unverified","message":"Please verify your email address before signing in"})
+        return
+    }
+    if s.totpEnabled(row.ID) {
+        s.recordLoginEvent(c, row.ID, identifier, eventLogin, outcomeChallenge, "2fa_required")
+        s.startLoginChallenge(c, row, identifier, remember)
+        return
+    }
+    s.issueLoginSession(c, row, identifier, remember, method)
+}
+
+// issueLoginSession creates the session and writes the login response. It is
+// the only place a successful attempt is recorded, which clears the
+// identifier's failure count.
+func (s *Server) issueLoginSession(c *gin.Context, row loginUser, identifier string, remember bool, method string) {
+    sid, csrf, expires, err := s.createSession(c, row.ID, remember)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create session"})
+        return
+    }
+    if identifier != "" {
+        s.recordLoginAttempt(identifier, c.ClientIP(), row.ID, true)
+    }
+    s.DB.Exec("UPDATE users SET last_login_at = now() WHERE id = ?", row.ID)
+    s.recordLoginEvent(c, row.ID, identifier, eventLogin, outcomeSuccess, method)
+    c.JSON(http.StatusOK, gin.H{"user": gin.H{"id": row.ID, "username": row.Username, "email": row.Email, "mobile": row.Mobile}, "session": gin.H{"sid": sid, "csrfToken": csrf, "expiresAt": expires}})
+}
+
+// sessionTTL is the idle lifetime of a session; rememberMe sessions live longer.
+func (s *Server) sessionTTL(remember bool) time.Duration {
+    if remember {
+        return s.Auth.SessionRememberTTL
+    }
+    return s.Auth.SessionIdleTTL
+}
+
+// createSession inserts a sessions row and sets the sid cookie. Non-remembered
+// sessions get a browser-session cookie (no Max-Age). It returns the sid and
+// the session's CSRF token.
+func (s *Server) createSession(c *gin.Context, userID string, remember bool) (string, string, time.Time, error) {
+    now := time.Now()
+    expires := now.Add(s.sessionTTL(remember))
+    if limit := now.Add(s.Auth.SessionAbsoluteTTL); expires.After(limit) {
+        expires = limit
+    }
+    var row struct{ SID string; CSRFToken string }
+    if err := s.DB.Raw("INSERT INTO sessions(user_id, expires_at, remember_me, user_agent, ip) VALUES (?, ?, ?, ?, ?) RETURNING sid, csrf_token",
+        userID, expires, remember, c.Request.UserAgent(), nullIfEmpty(c.ClientIP())).Scan(&row).Error; err != nil {
+        return "", "", time.Time{}, err
+    }
+    s.setSessionCookie(c, row.SID, remember, expires)
+    return row.SID, row.CSRFToken, expires, nil
+}
+
+// nullIfEmpty maps "" to SQL NULL for optional columns such as INET.
+func nullIfEmpty(v string) *string {
+    if v == "" {
+        return nil
+    }
+    return &v
+}
+
+func (s *Server) setSessionCookie(c *gin.Context, sid string, remember bool, expires time.Time) {
+    maxAge := 0
+    if remember {
+        maxAge = int(time.Until(expires).Seconds())
+    }
+    s.setCookie(c, "sid", sid, maxAge)
 }
 
 func (s *Server) logout(c *gin.Context) {
     sid, err := c.Cookie("sid")
     if err == nil && sid != "" {
         s.DB.Exec("UPDATE sessions SET revoked_at = now() WHERE sid = ?", sid)
+        if u := currentUser(c); u != nil && u.SID == sid {
+            s.recordLoginEvent(c, u.ID, "", eventLogout, outcomeSuccess, "")
+        }
+        s.setCookie(c, "sid", "", -1)
     }
     c.JSON(http.StatusNoContent, gin.H{})
 }
 
 func (s *Server) sessionMe(c *gin.Context) {
-    sid, err := c.Cookie("sid")
-    if err != nil || sid == "" {
-        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"no session"})
-        return
-    }
-    var row struct{ ID string; Username string; Email *string; Mobile *string }
-    s.DB.Raw(`SELECT u.id, u.username, u.email, u.mobile
-              FROM sessions s JOIN users u ON u.id = s.user_id
-              WHERE s.sid = ? AND (s.revoked_at IS NULL) AND s.expires_at > now() LIMIT 1`, sid).Scan(&row)
-    if row.ID == "" {
-        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"invalid session"})
-        return
-    }
-    c.JSON(http.StatusOK, gin.H{"user": row})
+    c.JSON(http.StatusOK, gin.H{"user": currentUser(c)})
 }
 
 func (s *Server) register(c *gin.Context) {
@@ -91,27 +182,82 @@ func (s *Server) register(c *gin.Context) {
         c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
         return
     }
-    if !req.AgreeTerms || req.Username == "" || req.Password == "" || req.Email == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"missing fields"})
+    v, errs := validateRegister(req, time.Now())
+    if len(errs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid registration data","details": errs})
         return
     }
-    hash, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-    // parse dates if provided
-    var passportExp, dob *time.Time
-    if req.PassportExpirationDate != "" {
-        if t, err := time.Parse("2006-01-02", req.PassportExpirationDate); err == nil { passportExp = &t }
-    }
-    if req.DateOfBirth != "" {
-        if t, err := time.Parse("2006-01-02", req.DateOfBirth); err == nil { dob = &t }
+    hash, err := s.Passwords.Hash(v.Password)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create account"})
+        return
     }
     // insert
     var uid string
-    err := s.DB.Raw(`INSERT INTO users(username,email,password_hash,name,nationality,passport_number,passport_expiration_date,date_of_birth,gender)
-                     VALUES (?,?,?,?,?,?,?,?,?) RETURNING id`,
-        req.Username, req.Email, string(hash), req.Name, req.Nationality, req.PassportNumber, passportExp, dob, req.Gender).Scan(&uid).Error
+    err = s.DB.Raw(`INSERT INTO users(username,email,password_hash,name,nationality,passport_number,passport_expiration_date,date_of_birth,gender,status)
+                     VALUES (?,?,?,?,?,?,?,?,?,'pending') RETURNING id`,
+        v.Username, v.Email, hash, v.Name, v.Nationality, v.PassportNumber, v.PassportExpiration, v.Birth, v.Gender).Scan(&uid).Error
     if err != nil {
-        c.JSON(http.StatusConflict, gin.H{"code":"conflict","message":"Already taken"})
+        if field, ok := uniqueViolation(err); ok {
+            c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages[field],"details": fieldErrors{field: "already taken"}})
+            return
+        }
+        log.Printf("register %s: %v", v.Username, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create account"})
         return
     }
-    c.JSON(http.StatusCreated, gin.H{"user": gin.H{"id": uid, "username": req.Username, "email": req.Email}, "next": "login"})
-}
\ No newline at end of file
+    if err := s.ensureSelfPassenger(uid); err != nil {
+        log.Printf("self passenger for %s: %v", uid, err)
+    }
+    if err := s.sendVerificationEmail(c.Request.Context(), uid, v.Email); err != nil {
+        log.Printf("verification email for %s: %v", uid, err)
+    }
+    c.JSON(http.StatusCreated, gin.H{"user": gin.H{"id": uid, "username": v.Username, "email": v.Email}, "next": "verify_email"})
+}
+
+// availabilityPerMinute bounds availability checks per client IP so the
+// endpoint cannot be used to enumerate accounts.
+const availabilityPerMinute = 20
+
+type availability struct {
+    Available bool   `json:"available"`
+    Reason    string `json:"reason,omitempty"`
+}
+
+// checkAvailability lets the registration form validate username and email
+// as the user types.
+func (s *Server) checkAvailability(c *gin.Context) {
+    username, email := c.Query("username"), c.Query("email")
+    if username == "" && email == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"username or email is required"})
+        return
+    }
+    resp := gin.H{}
+    if username != "" {
+        a := availability{Available: usernamePattern.MatchString(username)}
+        if !a.Available {
+            a.Reason = "invalid format"
+        } else {
+            var n int
+            s.DB.Raw("SELECT count(*) FROM users WHERE username = ?", username).Scan(&n)
+            if n > 0 {
+                a = availability{Reason: conflictMessages["username"]}
+            }
+        }
+        resp["username"] = a
+    }
+    if email != "" {
+        a := availability{Available: validateEmail(email) == ""}
+        if !a.Available {
+            a.Reason = "invalid format"
+        } else {
+            var n int
+            s.DB.Raw("SELECT count(*) FROM users WHERE email = ?", email).Scan(&n)
+            if n > 0 {
+                a = availability{Reason: conflictMessages["email"]}
+            }
+        }
+        resp["email"] = a
+    }
+    c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+// csrfHeader carries the session's synchronizer token on unsafe requests.
+const csrfHeader = "X-CSRF-Token"
+
+// CSRF rejects state-changing requests that ride on the sid cookie without
+// the session's CSRF token. Requests without a live cookie session have no
+// ambient credentials to abuse, and bearer tokens are never sent by the
+// browser on its own, so both pass through.
+func (s *Server) CSRF() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        switch c.Request.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+            c.Next()
+            return
+        }
+        u := currentUser(c)
+        if u == nil || u.SID == "" {
+            c.Next()
+            return
+        }
+        token := c.GetHeader(csrfHeader)
+        if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(u.CSRFToken)) != 1 {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code":"csrf_failed","message":"Missing or invalid CSRF token"})
+            return
+        }
+        c.Next()
+    }
+}
+
+// csrfToken returns the current session's token, for clients that did not
+// keep it from the login response.
+func (s *Server) csrfToken(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"csrfToken": currentUser(c).CSRFToken})
+}
+
+// setCookie writes an HttpOnly cookie with the configured Secure and SameSite
+// attributes. A negative maxAge deletes it; zero makes it a session cookie.
+func (s *Server) setCookie(c *gin.Context, name, value string, maxAge int) {
+    sameSite := http.SameSiteLaxMode
+    switch strings.ToLower(s.Auth.CookieSameSite) {
+    case "strict":
+        sameSite = http.SameSiteStrictMode
+    case "none":
+        sameSite = http.SameSiteNoneMode
+    }
+    http.SetCookie(c.Writer, &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   maxAge,
+        Secure:   s.Auth.CookieSecure || sameSite == http.SameSiteNoneMode,
+        HttpOnly: true,
+        SameSite: sameSite,
+    })
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+    "errors"
+
+    "github.com/jackc/pgx/v5/pgconn"
+)
+
+// uniqueFields maps unique constraints on users to the request field they guard.
+var uniqueFields = map[string]string{
+    "users_username_key": "username",
+    "users_email_key":    "email",
+    "users_mobile_key":   "mobile",
+    "passengers_document_key": "documentNumber",
+}
+
+// conflictMessages are the user-facing messages for each taken field.
+var conflictMessages = map[string]string{
+    "username": "Already taken",
+    "email":    "Email already registered",
+    "mobile":   "Mobile number already registered",
+    "documentNumber": "A passenger with this document already exists",
+}
+
+// uniqueViolation returns the field whose unique constraint err violated.
+func uniqueViolation(err error) (string, bool) {
+    var pgErr *pgconn.PgError
+    if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+        return "", false
+    }
+    field, ok := uniqueFields[pgErr.ConstraintName]
+    return field, ok
+}
+
+// checkViolation reports whether err is a check_violation of constraint,
+// including those raised by triggers such as passengers_limit.
+func checkViolation(err error, constraint string) bool {
+    var pgErr *pgconn.PgError
+    return errors.As(err, &pgErr) && pgErr.Code == "23514" && pgErr.ConstraintName == constraint
+}
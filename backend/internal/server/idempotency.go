@@ -0,0 +1,156 @@
+package server
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    idempotencyHeader = "Idempotency-Key"
+    // idempotencyReplayedHeader marks a response served from the stored copy.
+    idempotencyReplayedHeader = "Idempotent-Replayed"
+    idempotencyTTL            = 24 * time.Hour
+    // idempotencyLease is how long a claim survives without renewal. The
+    // claiming request renews it while it runs, so only a key whose instance
+    // died mid-request is freed.
+    idempotencyLease  = 30 * time.Second
+    maxIdempotencyKey = 255
+)
+
+// idempotencyWriter keeps a copy of the response so it can be stored.
+type idempotencyWriter struct {
+    gin.ResponseWriter
+    body bytes.Buffer
+}
+
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+    w.body.Write(b)
+    return w.ResponseWriter.Write(b)
+}
+
+func (w *idempotencyWriter) WriteString(v string) (int, error) {
+    w.body.WriteString(v)
+    return w.ResponseWriter.WriteString(v)
+}
+
+// requestFingerprint identifies what a key was first used for: the method,
+// path and body.
+func requestFingerprint(method, path string, body []byte) string {
+    h := sha256.New()
+    h.Write([]byte(method + " " + path + "\n"))
+    h.Write(body)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// Idempotent makes an unsafe endpoint safe to retry. A request carrying an
+// Idempotency-Key header claims the key for its user; once it completes, any
+// request with the same key and body gets the stored response instead of
+// running again, and one with a different body is refused. Server errors are
+// not stored, so the request can be retried. Must run after authentication;
+// requests without the header are passed through.
+func (s *Server) Idempotent() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        key := c.GetHeader(idempotencyHeader)
+        user := currentUser(c)
+        if key == "" || user == nil {
+            c.Next()
+            return
+        }
+        if len(key) > maxIdempotencyKey {
+            c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Idempotency-Key must be at most 255 characters"})
+            return
+        }
+        body, err := io.ReadAll(c.Request.Body)
+        if err != nil {
+            c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+            return
+        }
+        c.Request.Body = io.NopCloser(bytes.NewReader(body))
+        fingerprint := requestFingerprint(c.Request.Method, c.Request.URL.Path, body)
+
+        // keys live for a day; old ones are dropped when the user sends new ones
+        s.DB.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND (expires_at <= now() OR (status_code IS NULL AND lease_until <= now()))", user.ID)
+        var id int64
+        if err := s.DB.Raw(`INSERT INTO idempotency_keys(user_id, key, request_hash, expires_at, lease_until) VALUES (?, ?, ?, ?, ?)
+                            ON CONFLICT (user_id, key) DO NOTHING RETURNING id`,
+            user.ID, key, fingerprint, time.Now().Add(idempotencyTTL), time.Now().Add(idempotencyLease)).Scan(&id).Error; err != nil {
+            c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not record idempotency key"})
+            return
+        }
+        if id == 0 {
+            s.replayIdempotent(c, user.ID, key, fingerprint)
+            return
+        }
+
+        done := make(chan struct{})
+        go s.renewIdempotencyLease(id, done)
+        w := &idempotencyWriter{ResponseWriter: c.Writer}
+        c.Writer = w
+        func() {
+            // a panicking handler stops the renewals, so its claim lapses
+            defer close(done)
+            c.Next()
+        }()
+        if w.Status() >= http.StatusInternalServerError {
+            err = s.DB.Exec("DELETE FROM idempotency_keys WHERE id = ?", id).Error
+        } else {
+            err = s.DB.Exec("UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ? WHERE id = ?",
+                w.Status(), w.Header().Get("Content-Type"), w.body.Bytes(), id).Error
+        }
+        if err != nil {
+            log.Printf("idempotency key %d: %v", id, err)
+        }
+    }
+}
+
+// renewIdempotencyLease keeps the claim on key id alive until done is
+// closed, so a slow request is answered 409 in progress rather than run a
+// second time.
+func (s *Server) renewIdempotencyLease(id int64, done <-chan struct{}) {
+    t := time.NewTicker(idempotencyLease / 3)
+    defer t.Stop()
+    for {
+        select {
+        case <-done:
+            return
+        case <-t.C:
+            if err := s.DB.Exec("UPDATE idempotency_keys SET lease_until = ? WHERE id = ? AND status_code IS NULL",
+                time.Now().Add(idempotencyLease), id).Error; err != nil {
+                log.Printf("idempotency key %d: renew lease: %v", id, err)
+            }
+        }
+    }
+}
+
+// replayIdempotent answers a request whose key was already claimed.
+func (s *Server) replayIdempotent(c *gin.Context, userID, key, fingerprint string) {
+    var prev struct {
+        RequestHash  string
+        StatusCode   *int
+        ContentType  *string
+        ResponseBody []byte
+    }
+    if err := s.DB.Raw("SELECT request_hash, status_code, content_type, response_body FROM idempotency_keys WHERE user_id = ? AND key = ?",
+        userID, key).Scan(&prev).Error; err != nil {
+        c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not look up idempotency key"})
+        return
+    }
+    switch {
+    case prev.RequestHash != fingerprint:
+        c.AbortWithStatusJSON(http.StatusConflict, gin.H{"code":"idempotency_key_reused","message":"This Idempotency-Key was already used for a different request"})
+    case prev.StatusCode == nil:
+        c.Header("Retry-After", "1")
+        c.AbortWithStatusJSON(http.StatusConflict, gin.H{"code":"idempotency_in_progress","message":"A request with this Idempotency-Key is still being processed"})
+    default:
+        c.Header(idempotencyReplayedHeader, "true")
+        c.Data(*prev.StatusCode, deref(prev.ContentType), prev.ResponseBody)
+        c.Abort()
+    }
+}
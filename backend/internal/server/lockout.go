@@ -0,0 +1,77 @@
+package server
+
+import (
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// loginThrottle describes why a login attempt must be refused before the
+// password is even checked.
+type loginThrottle struct {
+    Status     int
+    Code       string
+    Message    string
+    RetryAfter time.Duration
+}
+
+type failureStats struct {
+    Failures    int
+    LastFailure *time.Time
+}
+
+// checkLoginThrottle applies per-IP rate limiting, per-identifier lockout and
+// progressive delays. Unknown identifiers are throttled exactly like real ones
+// so that the responses do not reveal which accounts exist.
+func (s *Server) checkLoginThrottle(identifier, ip string) *loginThrottle {
+    now := time.Now()
+    window := now.Add(-s.Auth.LoginFailureWindow)
+
+    var byIP failureStats
+    s.DB.Raw(`SELECT count(*) AS failures, max(created_at) AS last_failure FROM login_attempts
+              WHERE ip = ? AND success = false AND created_at > ?`, ip, window).Scan(&byIP)
+    if byIP.Failures >= s.Auth.LoginIPThreshold && byIP.LastFailure != nil {
+        return &loginThrottle{http.StatusTooManyRequests, "rate_limited", "Too many login attempts", byIP.LastFailure.Add(s.Auth.LoginFailureWindow).Sub(now)}
+    }
+
+    // only failures since the identifier's last successful login count
+    var byID failureStats
+    s.DB.Raw(`SELECT count(*) AS failures, max(created_at) AS last_failure FROM login_attempts
+              WHERE identifier = ? AND success = false AND created_at > ?
+              AND created_at > COALESCE((SELECT max(created_at) FROM login_attempts WHERE identifier = ? AND success), '-infinity')`,
+        identifier, window, identifier).Scan(&byID)
+    if byID.LastFailure == nil {
+        return nil
+    }
+    if byID.Failures >= s.Auth.LoginLockThreshold {
+        if wait := byID.LastFailure.Add(s.Auth.LoginLockDuration).Sub(now); wait > 0 {
+            return &loginThrottle{http.StatusLocked, "account_locked", "Account temporarily locked", wait}
+        }
+        return nil
+    }
+    if byID.Failures >= s.Auth.LoginDelayAfter {
+        // 1s, 2s, 4s, ... between attempts, capped at one minute
+        delay := time.Duration(math.Min(math.Pow(2, float64(byID.Failures-s.Auth.LoginDelayAfter)), 60)) * time.Second
+        if wait := byID.LastFailure.Add(delay).Sub(now); wait > 0 {
+            return &loginThrottle{http.StatusTooManyRequests, "rate_limited", "Too many login attempts", wait}
+        }
+    }
+    return nil
+}
+
+func (s *Server) recordLoginAttempt(identifier, ip, userID string, success bool) {
+    s.DB.Exec("INSERT INTO login_attempts(identifier, ip, user_id, success) VALUES (?, ?, ?, ?)",
+        identifier, nullIfEmpty(ip), nullIfEmpty(userID), success)
+}
+
+func (t *loginThrottle) respond(c *gin.Context) {
+    secs := int(math.Ceil(t.RetryAfter.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    c.Header("Retry-After", strconv.Itoa(secs))
+    c.JSON(t.Status, gin.H{"code": t.Code, "message": t.Message, "details": gin.H{"retryAfterSeconds": secs}})
+}
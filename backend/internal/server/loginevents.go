@@ -0,0 +1,63 @@
+package server
+
+import (
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Values of login_events.event.
+const (
+    eventLogin          = "login"
+    eventLogout         = "logout"
+    eventSessionRevoked = "session_revoked"
+)
+
+// Values of login_events.outcome.
+const (
+    outcomeSuccess   = "success"
+    outcomeFailure   = "failure"
+    outcomeChallenge = "challenge"
+)
+
+type loginEventItem struct {
+    Event     string    `json:"event"`
+    Outcome   string    `json:"outcome"`
+    Reason    *string   `json:"reason"`
+    IP        *string   `json:"ip"`
+    UserAgent *string   `json:"userAgent"`
+    CreatedAt time.Time `json:"createdAt"`
+}
+
+// recordLoginEvent appends to the audit trail. Failures to write are logged
+// but never fail the request.
+func (s *Server) recordLoginEvent(c *gin.Context, userID, identifier, event, outcome, reason string) {
+    err := s.DB.Exec("INSERT INTO login_events(user_id, identifier, event, outcome, reason, ip, user_agent) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        nullIfEmpty(userID), nullIfEmpty(identifier), event, outcome, nullIfEmpty(reason), nullIfEmpty(c.ClientIP()), nullIfEmpty(c.Request.UserAgent())).Error
+    if err != nil {
+        log.Printf("login event %s/%s: %v", event, outcome, err)
+    }
+}
+
+func (s *Server) loginHistory(c *gin.Context) {
+    user := currentUser(c)
+    page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+    pageSize, _ := strconv.Atoi(c.DefaultQuery("pageSize", "20"))
+    if page < 1 || pageSize < 1 || pageSize > 100 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"page must be >= 1 and pageSize between 1 and 100"})
+        return
+    }
+    var total int64
+    s.DB.Raw("SELECT count(*) FROM login_events WHERE user_id = ?", user.ID).Scan(&total)
+    items := []loginEventItem{}
+    if err := s.DB.Raw(`SELECT event, outcome, reason, host(ip) AS ip, user_agent, created_at FROM login_events
+                        WHERE user_id = ? ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?`,
+        user.ID, pageSize, (page-1)*pageSize).Scan(&items).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load login history"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items, "page": gin.H{"page": page, "pageSize": pageSize, "total": total}})
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// CurrentUser is the authenticated principal resolved from the request.
+type CurrentUser struct {
+    ID       string  `json:"id"`
+    Username string  `json:"username"`
+    Email    *string `json:"email"`
+    Mobile   *string `json:"mobile"`
+    Role     string  `json:"role"`
+    Status   string  `json:"-"`
+    SID      string  `json:"-"`
+    // CSRFToken belongs to the cookie session and must accompany its unsafe requests.
+    CSRFToken string `json:"-"`
+    // TokenID and Scopes are set when the request authenticated with a
+    // personal access token instead of the sid cookie.
+    TokenID string   `json:"-"`
+    Scopes  []string `json:"-"`
+}
+
+// HasScope reports whether the principal may use an endpoint guarded by
+// scope. Cookie sessions carry every scope.
+func (u *CurrentUser) HasScope(scope string) bool {
+    if u.TokenID == "" {
+        return true
+    }
+    for _, sc := range u.Scopes {
+        if sc == scope {
+            return true
+        }
+    }
+    return false
+}
+
+const currentUserKey = "currentUser"
+
+// resolveSession authenticates the request once and caches the result. An
+// Authorization: Bearer header takes precedence over the sid cookie.
+func (s *Server) resolveSession(c *gin.Context) *CurrentUser {
+    if v, ok := c.Get(currentUserKey); ok {
+        u, _ := v.(*CurrentUser)
+        return u
+    }
+    var u *CurrentUser
+    if token, ok := bearerToken(c); ok {
+        u = s.resolveAPIToken(token)
+    } else if sid, err := c.Cookie("sid"); err == nil && sid != "" {
+        var row struct {
+            ID         string
+            Username   string
+            Email      *string
+            Mobile     *string
+            Role       string
+            Status     string
+            CreatedAt  time.Time
+            ExpiresAt  time.Time
+            RememberMe bool
+            CSRFToken  string
+        }
+        s.DB.Raw(`SELECT u.id, u.username, u.email, u.mobile, u.role::text AS role, u.status, s.created_at, s.expires_at, s.remember_me, s.csrf_token
+                  FROM sessions s JOIN users u ON u.id = s.user_id
+                  WHERE s.sid = ? AND (s.revoked_at IS NULL) AND s.expires_at > now() LIMIT 1`, sid).Scan(&row)
+        if row.ID != "" {
+            u = &CurrentUser{ID: row.ID, Username: row.Username, Email: row.Email, Mobile: row.Mobile, Role: row.Role, Status: row.Status, SID: sid, CSRFToken: row.CSRFToken}
+            s.slideSession(c, sid, row.RememberMe, row.CreatedAt, row.ExpiresAt)
+        }
+    }
+    c.Set(currentUserKey, u)
+    return u
+}
+
+// bearerToken returns the token of an Authorization: Bearer header. Other
+// schemes are ignored so that they do not hide the sid cookie.
+func bearerToken(c *gin.Context) (string, bool) {
+    token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+    return strings.TrimSpace(token), ok
+}
+
+// slideSession pushes expires_at forward on activity, never past the absolute cap.
+// Writes are skipped until the expiry would move by at least a minute.
+func (s *Server) slideSession(c *gin.Context, sid string, remember bool, createdAt, expiresAt time.Time) {
+    next := time.Now().Add(s.sessionTTL(remember))
+    if limit := createdAt.Add(s.Auth.SessionAbsoluteTTL); next.After(limit) {
+        next = limit
+    }
+    if next.Sub(expiresAt) < time.Minute {
+        return
+    }
+    if err := s.DB.Exec("UPDATE sessions SET expires_at = ? WHERE sid = ? AND revoked_at IS NULL", next, sid).Error; err != nil {
+        return
+    }
+    if remember {
+        s.setSessionCookie(c, sid, true, next)
+    }
+}
+
+// OptionalSession attaches the current user to the context when a valid session exists.
+func (s *Server) OptionalSession() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        s.resolveSession(c)
+        c.Next()
+    }
+}
+
+// RequireSession aborts with 401 unless the request carries a live cookie
+// session. API tokens are refused with 403 so that they cannot manage the
+// account; routes open to tokens use RequireScope instead.
+func (s *Server) RequireSession() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        u := s.resolveSession(c)
+        if u == nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"login required"})
+            return
+        }
+        if u.TokenID != "" {
+            c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code":"forbidden","message":"API tokens cannot be used for this endpoint"})
+            return
+        }
+        c.Next()
+    }
+}
+
+// RequireScope accepts a cookie session, or an API token granted any of scopes.
+func (s *Server) RequireScope(scopes ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        u := s.resolveSession(c)
+        if u == nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"login required"})
+            return
+        }
+        for _, sc := range scopes {
+            if u.HasScope(sc) {
+                c.Next()
+                return
+            }
+        }
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code":"forbidden","message":"token lacks the required scope","details": gin.H{"requiredScopes": scopes}})
+    }
+}
+
+// TokenScope guards a public endpoint against API tokens without one of
+// scopes. Anonymous callers and cookie sessions pass; an unknown token is
+// refused rather than treated as anonymous.
+func (s *Server) TokenScope(scopes ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        u := s.resolveSession(c)
+        if u == nil {
+            if _, ok := bearerToken(c); ok {
+                c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"invalid or expired token"})
+                return
+            }
+            c.Next()
+            return
+        }
+        for _, sc := range scopes {
+            if u.HasScope(sc) {
+                c.Next()
+                return
+            }
+        }
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code":"forbidden","message":"token lacks the required scope","details": gin.H{"requiredScopes": scopes}})
+    }
+}
+
+// RequireRole accepts a cookie session whose user holds one of roles. API
+// tokens never carry a role.
+func (s *Server) RequireRole(roles ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        u := s.resolveSession(c)
+        if u == nil {
+            c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"login required"})
+            return
+        }
+        if u.TokenID == "" {
+            for _, r := range roles {
+                if u.Role == r {
+                    c.Next()
+                    return
+                }
+            }
+        }
+        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"code":"forbidden","message":"insufficient role","details": gin.H{"requiredRoles": roles}})
+    }
+}
+
+// currentUser returns the user stored by the session middleware, or nil.
+func currentUser(c *gin.Context) *CurrentUser {
+    v, ok := c.Get(currentUserKey)
+    if !ok {
+        return nil
+    }
+    u, _ := v.(*CurrentUser)
+    return u
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+    "crypto/subtle"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "time"
+
+    "cs3604/backend/internal/oidc"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    oidcStateCookie = "oidc_state"
+    oidcRequestTTL  = 10 * time.Minute
+)
+
+type oidcStartRequest struct {
+    RememberMe bool `json:"rememberMe"`
+}
+
+type oidcCallbackRequest struct {
+    Code  string `json:"code"`
+    State string `json:"state"`
+}
+
+// oidcRoutes implement the authorization code flow for a single-page app:
+// start returns the provider URL to navigate to, and the frontend page at
+// the redirect URL posts the code and state back to callback.
+func (s *Server) oidcRoutes(g *gin.RouterGroup) {
+    g.POST("/auth/oidc/start", s.startOIDCLogin)
+    g.POST("/auth/oidc/callback", s.finishOIDCLogin)
+}
+
+func (s *Server) oidcConfigured(c *gin.Context) bool {
+    if s.OIDC == nil {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"Single sign-on is not configured"})
+        return false
+    }
+    return true
+}
+
+// startOIDCLogin records state, nonce and PKCE verifier for the callback and
+// binds the state to this browser with a cookie.
+func (s *Server) startOIDCLogin(c *gin.Context) {
+    if !s.oidcConfigured(c) {
+        return
+    }
+    var req oidcStartRequest
+    if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    state, err := oidc.RandomString()
+    var nonce, verifier, challenge, authURL string
+    if err == nil {
+        nonce, err = oidc.RandomString()
+    }
+    if err == nil {
+        verifier, challenge, err = oidc.PKCE()
+    }
+    if err == nil {
+        authURL, err = s.OIDC.AuthURL(c.Request.Context(), state, nonce, challenge)
+    }
+    if err == nil {
+        err = s.DB.Exec("INSERT INTO oidc_auth_requests(state_hash, nonce, code_verifier, remember_me, expires_at) VALUES (?, ?, ?, ?, ?)",
+            hashToken(state), nonce, verifier, req.RememberMe, time.Now().Add(oidcRequestTTL)).Error
+    }
+    if err != nil {
+        log.Printf("oidc start: %v", err)
+        c.JSON(http.StatusBadGateway, gin.H{"code":"provider_unavailable","message":"Could not reach the identity provider"})
+        return
+    }
+    s.setCookie(c, oidcStateCookie, state, int(oidcRequestTTL.Seconds()))
+    c.JSON(http.StatusOK, gin.H{"authorizationUrl": authURL})
+}
+
+// finishOIDCLogin exchanges the code, then signs in the local account linked
+// to the external subject. An unlinked subject is linked to the account
+// signed in with a cookie session, or, if the provider is trusted for it, to
+// the account with the same verified email.
+func (s *Server) finishOIDCLogin(c *gin.Context) {
+    if !s.oidcConfigured(c) {
+        return
+    }
+    var req oidcCallbackRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" || req.State == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    cookie, _ := c.Cookie(oidcStateCookie)
+    var pending struct{ Nonce string; CodeVerifier string; RememberMe bool }
+    if cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(req.State)) == 1 {
+        s.DB.Raw(`DELETE FROM oidc_auth_requests WHERE state_hash = ? AND expires_at > now()
+                  RETURNING nonce, code_verifier, remember_me`, hashToken(req.State)).Scan(&pending)
+    }
+    s.setCookie(c, oidcStateCookie, "", -1)
+    if pending.Nonce == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_state","message":"Sign-in request is invalid or has expired"})
+        return
+    }
+    claims, err := s.OIDC.Exchange(c.Request.Context(), req.Code, pending.CodeVerifier, pending.Nonce)
+    if err != nil {
+        log.Printf("oidc callback: %v", err)
+        s.recordLoginEvent(c, "", "", eventLogin, outcomeFailure, "oidc_failed")
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Sign-in with the identity provider failed"})
+        return
+    }
+    row, err := s.linkedUser(c, claims)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not sign in"})
+        return
+    }
+    if row.ID == "" {
+        s.recordLoginEvent(c, "", claims.Email, eventLogin, outcomeFailure, "oidc_unlinked")
+        c.JSON(http.StatusForbidden, gin.H{"code":"account_not_linked","message":"No account is linked to this identity. Sign in to your account first to link it."})
+        return
+    }
+    s.completeLogin(c, row, claims.Email, pending.RememberMe, "oidc")
+}
+
+// linkedUser finds the account for an external identity. On first use the
+// subject is linked to the signed-in account, or with LinkByEmail to the
+// account with the same verified email; a pending account is then
+// activated, since the provider has proven ownership of the address.
+func (s *Server) linkedUser(c *gin.Context, claims *oidc.Claims) (loginUser, error) {
+    var row loginUser
+    issuer := s.OIDC.Issuer()
+    err := s.DB.Raw(`SELECT u.id, u.username, u.email, u.mobile, u.password_hash, u.status
+                     FROM user_identities i JOIN users u ON u.id = i.user_id
+                     WHERE i.issuer = ? AND i.subject = ? AND u.deleted_at IS NULL`, issuer, claims.Subject).Scan(&row).Error
+    if err != nil || row.ID != "" {
+        if row.ID != "" {
+            s.DB.Exec("UPDATE user_identities SET last_login_at = now(), email = ? WHERE issuer = ? AND subject = ?", nullIfEmpty(claims.Email), issuer, claims.Subject)
+        }
+        return row, err
+    }
+    byEmail := false
+    if u := currentUser(c); u != nil && u.TokenID == "" {
+        err = s.DB.Raw("SELECT id, username, email, mobile, password_hash, status FROM users WHERE id = ? AND deleted_at IS NULL", u.ID).Scan(&row).Error
+    } else if s.OIDC.LinkByEmail() && claims.Email != "" && claims.EmailVerified {
+        byEmail = true
+        err = s.DB.Raw("SELECT id, username, email, mobile, password_hash, status FROM users WHERE email = ? AND deleted_at IS NULL",
+            claims.Email).Scan(&row).Error
+    }
+    if err != nil || row.ID == "" {
+        return row, err
+    }
+    if err := s.DB.Exec(`INSERT INTO user_identities(user_id, issuer, subject, email, last_login_at) VALUES (?, ?, ?, ?, now())
+                         ON CONFLICT (issuer, subject) DO NOTHING`, row.ID, issuer, claims.Subject, nullIfEmpty(claims.Email)).Error; err != nil {
+        return loginUser{}, err
+    }
+    if byEmail && row.Status == statusPending {
+        if err := s.DB.Exec("UPDATE users SET status = ?, updated_at = now() WHERE id = ? AND status = ?", statusActive, row.ID, statusPending).Error; err != nil {
+            return loginUser{}, err
+        }
+        row.Status = statusActive
+    }
+    return row, nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+    "errors"
+    "net/http"
+
+    "cs3604/backend/internal/orders"
+
+    "github.com/gin-gonic/gin"
+)
+
+type orderReq struct {
+    PreorderID string `json:"preorderId"`
+}
+
+func (s *Server) orderRoutes(g *gin.RouterGroup) {
+    og := g.Group("/orders", s.RequireScope(scopeBooking))
+    og.GET("", s.listOrders)
+    og.POST("", s.Idempotent(), s.createOrder)
+    og.GET("/:id", s.getOrder)
+}
+
+func (s *Server) listOrders(c *gin.Context) {
+    items, err := s.Orders.List(c.Request.Context(), currentUser(c).ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load orders"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (s *Server) getOrder(c *gin.Context) {
+    o, err := s.Orders.Get(c.Request.Context(), currentUser(c).ID, c.Param("id"))
+    if errors.Is(err, orders.ErrNotFound) {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"order not found"})
+        return
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load order"})
+        return
+    }
+    c.JSON(http.StatusOK, o)
+}
+
+// createOrder confirms one of the user's preorders. The held seats move to
+// the order, so this only succeeds while the hold is active.
+func (s *Server) createOrder(c *gin.Context) {
+    user := currentUser(c)
+    if user.Status == statusPending {
+        c.JSON(http.StatusForbidden, gin.H{"code":"email_unverified","message":"Please verify your email address before booking"})
+        return
+    }
+    var req orderReq
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    if req.PreorderID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request","details": fieldErrors{"preorderId": "required"}})
+        return
+    }
+    o, err := s.Orders.CreateFromPreorder(c.Request.Context(), user.ID, req.PreorderID)
+    switch {
+    case errors.Is(err, orders.ErrPreorderNotFound):
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"preorder not found"})
+    case errors.Is(err, orders.ErrPreorderNotActive):
+        c.JSON(http.StatusConflict, gin.H{"code":"preorder_not_active","message":"Only active preorders can be turned into an order"})
+    case err != nil:
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create order"})
+    default:
+        c.JSON(http.StatusCreated, o)
+    }
+}
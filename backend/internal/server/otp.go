@@ -0,0 +1,245 @@
+package server
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "regexp"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// Purposes of rows in otp_codes.
+const (
+    otpLogin      = "login"
+    otpBindMobile = "bind_mobile"
+)
+
+// One-time code policy.
+const (
+    otpTTL         = 5 * time.Minute
+    otpResendAfter = time.Minute
+    otpPerHour     = 5
+    otpMaxAttempts = 5
+)
+
+var mobilePattern = regexp.MustCompile(`^\+?[1-9][0-9]{6,14}$`)
+
+var errOTPRateLimited = errors.New("otp rate limited")
+
+type mobileRequest struct {
+    Mobile string `json:"mobile"`
+}
+
+type mobileVerifyRequest struct {
+    Mobile     string `json:"mobile"`
+    Code       string `json:"code"`
+    RememberMe bool   `json:"rememberMe"`
+}
+
+func (s *Server) otpRoutes(g *gin.RouterGroup) {
+    g.POST("/auth/otp/request", s.requestLoginOTP)
+    g.POST("/auth/otp/login", s.loginWithOTP)
+    g.POST("/users/me/mobile", s.RequireSession(), s.requestBindMobile)
+    g.POST("/users/me/mobile/verify", s.RequireSession(), s.verifyBindMobile)
+}
+
+// normalizeMobile strips common separators and checks for an E.164-like number.
+func normalizeMobile(v string) (string, bool) {
+    v = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(v)
+    return v, mobilePattern.MatchString(v)
+}
+
+func hashOTP(mobile, code string) string {
+    return hashToken(mobile + ":" + code)
+}
+
+// issueOTP stores a new code for mobile and texts it unless send is false.
+// Rows are written even when nothing is sent so that rate limits behave the
+// same for unknown numbers. Requests are limited per number and, so that one
+// client cannot spread texts across many numbers, per IP.
+func (s *Server) issueOTP(c *gin.Context, mobile, purpose, userID string, send bool) (time.Duration, error) {
+    ip := c.ClientIP()
+    var byIP struct{ Count int; First *time.Time }
+    s.DB.Raw(`SELECT count(*) AS count, min(created_at) AS first FROM otp_codes
+              WHERE ip = ? AND created_at > now() - interval '1 hour'`, ip).Scan(&byIP)
+    if byIP.Count >= s.Auth.OTPIPPerHour && byIP.First != nil {
+        if wait := time.Until(byIP.First.Add(time.Hour)); wait > 0 {
+            return wait, errOTPRateLimited
+        }
+    }
+    var sent struct{ Count int; First *time.Time; Last *time.Time }
+    s.DB.Raw(`SELECT count(*) AS count, min(created_at) AS first, max(created_at) AS last FROM otp_codes
+              WHERE mobile = ? AND created_at > now() - interval '1 hour'`, mobile).Scan(&sent)
+    if sent.Last != nil {
+        wait := time.Until(sent.Last.Add(otpResendAfter))
+        if sent.Count >= otpPerHour {
+            wait = time.Until(sent.First.Add(time.Hour))
+        }
+        if wait > 0 {
+            return wait, errOTPRateLimited
+        }
+    }
+    n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+    if err != nil {
+        return 0, err
+    }
+    code := fmt.Sprintf("%06d", n.Int64())
+    if err := s.DB.Exec(`UPDATE otp_codes SET consumed_at = now() WHERE mobile = ? AND purpose = ? AND consumed_at IS NULL`, mobile, purpose).Error; err != nil {
+        return 0, err
+    }
+    if err := s.DB.Exec("INSERT INTO otp_codes(mobile, purpose, user_id, code_hash, expires_at, ip) VALUES (?, ?, ?, ?, ?, ?)",
+        mobile, purpose, nullIfEmpty(userID), hashOTP(mobile, code), time.Now().Add(otpTTL), nullIfEmpty(ip)).Error; err != nil {
+        return 0, err
+    }
+    if !send {
+        return 0, nil
+    }
+    return 0, s.SMS.SendSMS(c.Request.Context(), mobile, fmt.Sprintf("[12306] Your verification code is %s. It expires in %d minutes.", code, int(otpTTL.Minutes())))
+}
+
+// checkOTP verifies code against the newest live code for mobile and purpose
+// and returns the user it was issued for. Each code allows otpMaxAttempts tries.
+func (s *Server) checkOTP(mobile, purpose, code string) (string, bool, error) {
+    var userID string
+    var ok bool
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        var row struct{ ID int64; UserID *string; CodeHash string; Attempts int }
+        if err := tx.Raw(`SELECT id, user_id, code_hash, attempts FROM otp_codes
+                          WHERE mobile = ? AND purpose = ? AND consumed_at IS NULL AND expires_at > now()
+                          ORDER BY created_at DESC LIMIT 1 FOR UPDATE`, mobile, purpose).Scan(&row).Error; err != nil {
+            return err
+        }
+        if row.ID == 0 || row.Attempts >= otpMaxAttempts {
+            return nil
+        }
+        if subtle.ConstantTimeCompare([]byte(row.CodeHash), []byte(hashOTP(mobile, code))) != 1 {
+            return tx.Exec("UPDATE otp_codes SET attempts = attempts + 1 WHERE id = ?", row.ID).Error
+        }
+        if row.UserID != nil {
+            userID, ok = *row.UserID, true
+        }
+        return tx.Exec("UPDATE otp_codes SET consumed_at = now() WHERE id = ?", row.ID).Error
+    })
+    return userID, ok, err
+}
+
+func respondOTPRateLimited(c *gin.Context, wait time.Duration) {
+    secs := int(wait.Seconds()) + 1
+    c.Header("Retry-After", fmt.Sprint(secs))
+    c.JSON(http.StatusTooManyRequests, gin.H{"code":"rate_limited","message":"Please wait before requesting another code","details": gin.H{"retryAfterSeconds": secs}})
+}
+
+// requestLoginOTP texts a login code to a bound number. The response is the
+// same whether or not the number belongs to an account.
+func (s *Server) requestLoginOTP(c *gin.Context) {
+    var req mobileRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    mobile, valid := normalizeMobile(req.Mobile)
+    if !valid {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid mobile number","details": gin.H{"mobile": "invalid format"}})
+        return
+    }
+    var userID string
+    s.DB.Raw("SELECT id FROM users WHERE mobile = ? LIMIT 1", mobile).Scan(&userID)
+    if wait, err := s.issueOTP(c, mobile, otpLogin, userID, userID != ""); err != nil {
+        if errors.Is(err, errOTPRateLimited) {
+            respondOTPRateLimited(c, wait)
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not send code"})
+        return
+    }
+    c.JSON(http.StatusAccepted, gin.H{"message": "If the number is registered, a code has been sent", "expiresInSeconds": int(otpTTL.Seconds())})
+}
+
+func (s *Server) loginWithOTP(c *gin.Context) {
+    var req mobileVerifyRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    mobile, _ := normalizeMobile(req.Mobile)
+    userID, ok, err := s.checkOTP(mobile, otpLogin, req.Code)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not verify code"})
+        return
+    }
+    var row loginUser
+    if ok {
+        s.DB.Raw("SELECT id, username, email, mobile, password_hash, status FROM users WHERE id = ? AND mobile = ?", userID, mobile).Scan(&row)
+    }
+    if row.ID == "" {
+        s.recordLoginEvent(c, "", mobile, eventLogin, outcomeFailure, "invalid_code")
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid or expired code"})
+        return
+    }
+    s.completeLogin(c, row, mobile, req.RememberMe, "otp")
+}
+
+// requestBindMobile texts a code to a number the signed-in user wants to add.
+func (s *Server) requestBindMobile(c *gin.Context) {
+    user := currentUser(c)
+    var req mobileRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    mobile, valid := normalizeMobile(req.Mobile)
+    if !valid {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid mobile number","details": gin.H{"mobile": "invalid format"}})
+        return
+    }
+    var owner string
+    s.DB.Raw("SELECT id FROM users WHERE mobile = ? LIMIT 1", mobile).Scan(&owner)
+    if owner != "" && owner != user.ID {
+        c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages["mobile"],"details": fieldErrors{"mobile": "already taken"}})
+        return
+    }
+    if wait, err := s.issueOTP(c, mobile, otpBindMobile, user.ID, true); err != nil {
+        if errors.Is(err, errOTPRateLimited) {
+            respondOTPRateLimited(c, wait)
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not send code"})
+        return
+    }
+    c.JSON(http.StatusAccepted, gin.H{"message": "Code sent", "expiresInSeconds": int(otpTTL.Seconds())})
+}
+
+func (s *Server) verifyBindMobile(c *gin.Context) {
+    user := currentUser(c)
+    var req mobileVerifyRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    mobile, _ := normalizeMobile(req.Mobile)
+    userID, ok, err := s.checkOTP(mobile, otpBindMobile, req.Code)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not verify code"})
+        return
+    }
+    if !ok || userID != user.ID {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_code","message":"Invalid or expired code"})
+        return
+    }
+    if err := s.DB.Exec("UPDATE users SET mobile = ?, updated_at = now() WHERE id = ?", mobile, user.ID).Error; err != nil {
+        if field, ok := uniqueViolation(err); ok {
+            c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages[field],"details": fieldErrors{field: "already taken"}})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not update mobile"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user": gin.H{"id": user.ID, "username": user.Username, "email": user.Email, "mobile": mobile}})
+}
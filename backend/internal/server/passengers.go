@@ -0,0 +1,395 @@
+package server
+
+import (
+    "net/http"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "cs3604/backend/internal/validation"
+
+    "github.com/gin-gonic/gin"
+)
+
+// maxPassengers mirrors the passengers_limit trigger, which is what actually
+// enforces the cap.
+const maxPassengers = 15
+
+// Values of ticket_type_enum.
+const (
+    ticketAdult   = "adult"
+    ticketChild   = "child"
+    ticketStudent = "student"
+)
+
+type passengerInput struct {
+    Name                   string `json:"name"`
+    DocumentType           string `json:"documentType"`
+    DocumentNumber         string `json:"documentNumber"`
+    Nationality            string `json:"nationality"`
+    DateOfBirth            string `json:"dateOfBirth"`
+    Gender                 string `json:"gender"`
+    TicketType             string `json:"ticketType"`
+    // DocumentExpirationDate may be omitted for long-term resident ID cards.
+    DocumentExpirationDate string `json:"documentExpirationDate"`
+}
+
+type passengerPatch struct {
+    Name                   *string `json:"name"`
+    DocumentType           *string `json:"documentType"`
+    DocumentNumber         *string `json:"documentNumber"`
+    Nationality            *string `json:"nationality"`
+    DateOfBirth            *string `json:"dateOfBirth"`
+    Gender                 *string `json:"gender"`
+    TicketType             *string `json:"ticketType"`
+    DocumentExpirationDate *string `json:"documentExpirationDate"`
+}
+
+type passengerItem struct {
+    ID                     string    `json:"id"`
+    Name                   string    `json:"name"`
+    DocumentType           string    `json:"documentType"`
+    DocumentNumber         string    `json:"documentNumber"`
+    Nationality            *string   `json:"nationality"`
+    DocumentExpirationDate *string   `json:"documentExpirationDate"`
+    DateOfBirth            string    `json:"dateOfBirth"`
+    Gender                 *string   `json:"gender"`
+    TicketType             string    `json:"ticketType"`
+    EligibleTicketTypes    []string  `json:"eligibleTicketTypes" gorm:"-"`
+    VerificationStatus     string    `json:"verificationStatus"`
+    IsSelf                 bool      `json:"isSelf"`
+    CreatedAt              time.Time `json:"createdAt"`
+}
+
+const passengerColumns = `id, name, document_type::text AS document_type, document_number, nationality,
+    to_char(document_expiration_date, 'YYYY-MM-DD') AS document_expiration_date,
+    to_char(date_of_birth, 'YYYY-MM-DD') AS date_of_birth, gender::text AS gender, ticket_type::text AS ticket_type,
+    verification_status::text AS verification_status, is_self, created_at`
+
+func (s *Server) passengerRoutes(g *gin.RouterGroup) {
+    pg := g.Group("/passengers", s.RequireScope(scopeBooking))
+    pg.GET("", s.listPassengers)
+    pg.POST("", s.createPassenger)
+    pg.PATCH("/:id", s.updatePassenger)
+    pg.DELETE("/:id", s.deletePassenger)
+}
+
+// ageOn returns the age in whole years on day.
+func ageOn(dob, day time.Time) int {
+    age := day.Year() - dob.Year()
+    if day.Month() < dob.Month() || (day.Month() == dob.Month() && day.Day() < dob.Day()) {
+        age--
+    }
+    return age
+}
+
+// eligibleTicketTypes applies the fare rules by age: children under 14 may
+// travel on a child ticket, and anyone of school age (6+) may hold a student
+// ticket, which is checked against student status at the gate.
+func eligibleTicketTypes(dob, today time.Time) []string {
+    types := []string{ticketAdult}
+    age := ageOn(dob, today)
+    if age < 14 {
+        types = append(types, ticketChild)
+    }
+    if age >= 6 {
+        types = append(types, ticketStudent)
+    }
+    return types
+}
+
+// validPassenger is a passengerInput that passed validatePassenger, with
+// fields normalized, filled in from the document and dates parsed.
+type validPassenger struct {
+    passengerInput
+    Birth              time.Time
+    DocumentExpiration *time.Time
+}
+
+// validatePassenger checks a passenger as a whole: the document number must
+// be well formed and must agree with the nationality, birth date and gender
+// it encodes. With checkExpiry the document must also be unexpired.
+func validatePassenger(in passengerInput, now time.Time, checkExpiry bool) (validPassenger, fieldErrors) {
+    errs := fieldErrors{}
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    out := validPassenger{passengerInput: in}
+
+    out.Name = strings.TrimSpace(in.Name)
+    if out.Name == "" {
+        errs.add("name", "required")
+    } else if utf8.RuneCountInString(out.Name) > 100 {
+        errs.add("name", "must be at most 100 characters")
+    }
+
+    out.Nationality = strings.ToUpper(strings.TrimSpace(in.Nationality))
+    if out.Nationality != "" && !validNationality(out.Nationality) {
+        errs.add("nationality", "must be an ISO 3166-1 alpha-2 country code")
+    }
+
+    // the document decides what the other fields must say
+    var resident *validation.ResidentIDInfo
+    out.DocumentNumber = validation.Normalize(in.DocumentNumber)
+    switch in.DocumentType {
+    case validation.ResidentID:
+        if out.DocumentNumber == "" {
+            errs.add("documentNumber", "required")
+        } else if info, err := validation.ParseResidentID(out.DocumentNumber, today); err != nil {
+            errs.add("documentNumber", err.Error())
+        } else {
+            resident = &info
+        }
+        if out.Nationality == "" {
+            out.Nationality = "CN"
+        } else if out.Nationality != "CN" {
+            errs.add("nationality", "resident ID cards are only issued to CN nationals")
+        }
+    case validation.Passport:
+        if out.Nationality == "" {
+            errs.add("nationality", "required for passports")
+        }
+        if out.DocumentNumber == "" {
+            errs.add("documentNumber", "required")
+        } else if err := validation.CheckPassport(out.Nationality, out.DocumentNumber); err != nil {
+            errs.add("documentNumber", err.Error())
+        }
+    case validation.HKMacauPermit, validation.TaiwanPermit:
+        if out.DocumentNumber == "" {
+            errs.add("documentNumber", "required")
+        } else if holder, err := validation.ParsePermit(in.DocumentType, out.DocumentNumber); err != nil {
+            errs.add("documentNumber", err.Error())
+        } else if out.Nationality == "" {
+            out.Nationality = holder
+        } else if out.Nationality != holder {
+            errs.add("nationality", "does not match the permit, which is issued to "+holder+" residents")
+        }
+    case "":
+        errs.add("documentType", "required")
+    default:
+        errs.add("documentType", "must be passport, resident_id, hk_macau_permit or taiwan_permit")
+    }
+
+    // resident IDs do not always show an expiry date ("long-term" cards)
+    if in.DocumentExpirationDate != "" || in.DocumentType != validation.ResidentID {
+        if exp := parseDate(errs, "documentExpirationDate", in.DocumentExpirationDate); exp != nil {
+            if err := validation.CheckExpiry(*exp, now); checkExpiry && err != nil {
+                errs.add("documentExpirationDate", err.Error())
+            }
+            out.DocumentExpiration = exp
+        }
+    }
+
+    if in.DateOfBirth == "" && resident != nil {
+        out.Birth = resident.Birth
+        out.DateOfBirth = out.Birth.Format("2006-01-02")
+    } else if d := parseDate(errs, "dateOfBirth", in.DateOfBirth); d != nil {
+        if d.After(today) {
+            errs.add("dateOfBirth", "must not be in the future")
+        } else if d.Year() < 1900 {
+            errs.add("dateOfBirth", "must be after 1900-01-01")
+        } else if resident != nil && !d.Equal(resident.Birth) {
+            errs.add("dateOfBirth", "does not match the resident ID number")
+        }
+        out.Birth = *d
+    }
+
+    switch {
+    case in.Gender != "" && in.Gender != "male" && in.Gender != "female":
+        errs.add("gender", "must be male or female")
+    case resident != nil && in.Gender == "":
+        out.Gender = resident.Gender
+    case resident != nil && in.Gender != resident.Gender:
+        errs.add("gender", "does not match the resident ID number")
+    }
+
+    if out.TicketType == "" {
+        out.TicketType = ticketAdult
+    }
+    if !out.Birth.IsZero() && !contains(eligibleTicketTypes(out.Birth, today), out.TicketType) {
+        errs.add("ticketType", "passenger is not eligible for this ticket type")
+    }
+    return out, errs
+}
+
+// ensureSelfPassenger adds the account holder as a passenger from the
+// registration data, once.
+func (s *Server) ensureSelfPassenger(userID string) error {
+    return s.DB.Exec(`INSERT INTO passengers(user_id, name, document_type, document_number, document_expiration_date, nationality, date_of_birth, gender, is_self)
+                      SELECT id, name, 'passport', passport_number, passport_expiration_date, nationality, date_of_birth, gender, true FROM users
+                      WHERE id = ? AND name IS NOT NULL AND passport_number IS NOT NULL AND date_of_birth IS NOT NULL
+                      AND NOT EXISTS (SELECT 1 FROM passengers WHERE user_id = users.id AND is_self)
+                      ON CONFLICT DO NOTHING`, userID).Error
+}
+
+// syncSelfPassenger copies profile changes onto the account holder's
+// passenger. A new passport number has to be verified again.
+func (s *Server) syncSelfPassenger(userID string) error {
+    err := s.DB.Exec(`UPDATE passengers p SET name = u.name, document_number = u.passport_number,
+                             document_expiration_date = u.passport_expiration_date, nationality = u.nationality,
+                             date_of_birth = u.date_of_birth, gender = u.gender, updated_at = now(),
+                             verification_status = CASE WHEN p.document_number = u.passport_number THEN p.verification_status ELSE 'pending' END
+                      FROM users u
+                      WHERE u.id = p.user_id AND p.user_id = ? AND p.is_self
+                      AND u.name IS NOT NULL AND u.passport_number IS NOT NULL AND u.date_of_birth IS NOT NULL`, userID).Error
+    if err != nil {
+        return err
+    }
+    return s.ensureSelfPassenger(userID)
+}
+
+func (s *Server) loadPassengers(userID, id string) ([]passengerItem, error) {
+    q := "SELECT " + passengerColumns + " FROM passengers WHERE user_id = ?"
+    args := []any{userID}
+    if id != "" {
+        q += " AND id::text = ?"
+        args = append(args, id)
+    }
+    items := []passengerItem{}
+    if err := s.DB.Raw(q+" ORDER BY is_self DESC, created_at", args...).Scan(&items).Error; err != nil {
+        return nil, err
+    }
+    today := time.Now()
+    for i := range items {
+        if dob, err := time.Parse("2006-01-02", items[i].DateOfBirth); err == nil {
+            items[i].EligibleTicketTypes = eligibleTicketTypes(dob, today)
+        }
+    }
+    return items, nil
+}
+
+func (s *Server) listPassengers(c *gin.Context) {
+    user := currentUser(c)
+    if err := s.ensureSelfPassenger(user.ID); err != nil && !checkViolation(err, "passengers_limit") {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load passengers"})
+        return
+    }
+    items, err := s.loadPassengers(user.ID, "")
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load passengers"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items, "limit": maxPassengers})
+}
+
+// respondPassengerWriteError maps constraint failures of a passengers write.
+func respondPassengerWriteError(c *gin.Context, err error) {
+    if checkViolation(err, "passengers_limit") {
+        c.JSON(http.StatusConflict, gin.H{"code":"passenger_limit","message":"You can save at most 15 passengers","details": gin.H{"limit": maxPassengers}})
+        return
+    }
+    if field, ok := uniqueViolation(err); ok {
+        c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages[field],"details": fieldErrors{field: "already taken"}})
+        return
+    }
+    c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not save passenger"})
+}
+
+func (s *Server) createPassenger(c *gin.Context) {
+    user := currentUser(c)
+    var req passengerInput
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    v, errs := validatePassenger(req, time.Now(), true)
+    if len(errs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid passenger data","details": errs})
+        return
+    }
+    var id string
+    err := s.DB.Raw(`INSERT INTO passengers(user_id, name, document_type, document_number, document_expiration_date, nationality, date_of_birth, gender, ticket_type)
+                     VALUES (?, ?, ?, ?, ?, ?, ?, CAST(? AS gender_enum), ?) RETURNING id`,
+        user.ID, v.Name, v.DocumentType, v.DocumentNumber, v.DocumentExpiration, nullIfEmpty(v.Nationality), v.Birth, nullIfEmpty(v.Gender), v.TicketType).Scan(&id).Error
+    if err != nil {
+        respondPassengerWriteError(c, err)
+        return
+    }
+    items, err := s.loadPassengers(user.ID, id)
+    if err != nil || len(items) == 0 {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load passenger"})
+        return
+    }
+    c.JSON(http.StatusCreated, items[0])
+}
+
+// updatePassenger merges the patch into the stored passenger and validates
+// the result as a whole. The account holder is edited through the profile.
+func (s *Server) updatePassenger(c *gin.Context) {
+    user := currentUser(c)
+    var req passengerPatch
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    items, err := s.loadPassengers(user.ID, c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load passenger"})
+        return
+    }
+    if len(items) == 0 {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"passenger not found"})
+        return
+    }
+    cur := items[0]
+    if cur.IsSelf {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Update your own details through the profile"})
+        return
+    }
+    in := passengerInput{Name: cur.Name, DocumentType: cur.DocumentType, DocumentNumber: cur.DocumentNumber,
+        Nationality: deref(cur.Nationality), DateOfBirth: cur.DateOfBirth, Gender: deref(cur.Gender), TicketType: cur.TicketType,
+        DocumentExpirationDate: deref(cur.DocumentExpirationDate)}
+    for _, f := range []struct{ dst *string; src *string }{
+        {&in.Name, req.Name}, {&in.DocumentType, req.DocumentType}, {&in.DocumentNumber, req.DocumentNumber},
+        {&in.Nationality, req.Nationality}, {&in.DateOfBirth, req.DateOfBirth}, {&in.Gender, req.Gender}, {&in.TicketType, req.TicketType},
+        {&in.DocumentExpirationDate, req.DocumentExpirationDate},
+    } {
+        if f.src != nil {
+            *f.dst = *f.src
+        }
+    }
+    // a passenger whose document has run out must stay editable, so the
+    // expiry only counts when the document itself is being changed
+    documentChanged := in.DocumentType != cur.DocumentType || validation.Normalize(in.DocumentNumber) != cur.DocumentNumber ||
+        in.DocumentExpirationDate != deref(cur.DocumentExpirationDate)
+    v, errs := validatePassenger(in, time.Now(), documentChanged)
+    if len(errs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid passenger data","details": errs})
+        return
+    }
+    // a changed document has to be verified again
+    err = s.DB.Exec(`UPDATE passengers SET name = ?, document_type = ?, document_number = ?, document_expiration_date = ?,
+                            nationality = ?, date_of_birth = ?,
+                            gender = CAST(? AS gender_enum), ticket_type = ?, updated_at = now(),
+                            verification_status = CASE WHEN document_type::text = ? AND document_number = ? THEN verification_status ELSE 'pending' END
+                     WHERE id = ? AND user_id = ?`,
+        v.Name, v.DocumentType, v.DocumentNumber, v.DocumentExpiration, nullIfEmpty(v.Nationality), v.Birth, nullIfEmpty(v.Gender), v.TicketType,
+        v.DocumentType, v.DocumentNumber, cur.ID, user.ID).Error
+    if err != nil {
+        respondPassengerWriteError(c, err)
+        return
+    }
+    items, err = s.loadPassengers(user.ID, cur.ID)
+    if err != nil || len(items) == 0 {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load passenger"})
+        return
+    }
+    c.JSON(http.StatusOK, items[0])
+}
+
+func (s *Server) deletePassenger(c *gin.Context) {
+    user := currentUser(c)
+    var isSelf *bool
+    s.DB.Raw("SELECT is_self FROM passengers WHERE id::text = ? AND user_id = ?", c.Param("id"), user.ID).Scan(&isSelf)
+    if isSelf == nil {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"passenger not found"})
+        return
+    }
+    if *isSelf {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"The account holder cannot be removed"})
+        return
+    }
+    if err := s.DB.Exec("DELETE FROM passengers WHERE id::text = ? AND user_id = ?", c.Param("id"), user.ID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not delete passenger"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
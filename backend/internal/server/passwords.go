@@ -0,0 +1,21 @@
+package server
+
+import "log"
+
+// checkPassword verifies a password against the user's stored hash and, on a
+// match, upgrades the hash when it was made under an older policy.
+func (s *Server) checkPassword(userID, encoded, password string) bool {
+    match, rehash := s.Passwords.Verify(password, encoded)
+    if !match || !rehash {
+        return match
+    }
+    fresh, err := s.Passwords.Hash(password)
+    if err == nil {
+        // only replace the hash we checked, in case it changed meanwhile
+        err = s.DB.Exec("UPDATE users SET password_hash = ? WHERE id = ? AND password_hash = ?", fresh, userID, encoded).Error
+    }
+    if err != nil {
+        log.Printf("rehash password for %s: %v", userID, err)
+    }
+    return true
+}
@@ -1,34 +1,308 @@
 package server
 
 import (
+    "fmt"
+    "log"
     "net/http"
     "time"
 
+    "cs3604/backend/internal/validation"
+
     "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
 )
 
+// maxPreorderPassengers follows the 12306 rule of five travellers per booking.
+const maxPreorderPassengers = 5
+
+// bookingRangeDays is how many days ahead, today included, services are
+// on sale; it matches the rolling 14-day window of train_services.
+const bookingRangeDays = 14
+
+// parseTravelDate checks a travel date's format and that it falls within
+// the booking window.
+func parseTravelDate(v string, now time.Time) (time.Time, string) {
+    travel, err := time.Parse("2006-01-02", v)
+    if err != nil {
+        return time.Time{}, "must be a date in YYYY-MM-DD format"
+    }
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    if travel.Before(today) || !travel.Before(today.AddDate(0, 0, bookingRangeDays)) {
+        return time.Time{}, fmt.Sprintf("must be within the next %d days", bookingRangeDays)
+    }
+    return travel, ""
+}
+
 type preorderReq struct {
     TrainNo        string `json:"trainNo"`
     Date           string `json:"date"`
     FromStationId  string `json:"fromStationId"`
     ToStationId    string `json:"toStationId"`
     SeatType       string `json:"seatType"`
+    // Passengers get one seat each. Without them a single seat is held for
+    // the account holder, as before.
+    Passengers []preorderPassengerReq `json:"passengers"`
 }
 
+type preorderPassengerReq struct {
+    PassengerID string `json:"passengerId"`
+    TicketType  string `json:"ticketType"`
+}
+
+// preorderPassenger is the traveller snapshot stored for one held seat.
+type preorderPassenger struct {
+    PreorderID     string  `json:"-"`
+    PassengerID    *string `json:"passengerId"`
+    Name           string  `json:"name"`
+    DocumentType   string  `json:"documentType"`
+    DocumentNumber string  `json:"documentNumber"`
+    TicketType     string  `json:"ticketType"`
+    PriceCents     int     `json:"priceCents"`
+}
+
+// preorderStatuses are the values of preorder_status_enum a list can be
+// filtered by.
+var preorderStatuses = []string{"active", "expired", "canceled", "converted"}
+
+// preorderItem is a preorder joined with its train, stations and fare.
+// PriceCents is the class price; TotalCents prices each traveller by ticket
+// type, and seats held without passengers as adult. Status reads "expired"
+// as soon as the hold runs out, even before the sweeper has released the
+// seat.
+type preorderItem struct {
+    ID               string              `json:"id"`
+    Status           string              `json:"status"`
+    TrainNo          string              `json:"trainNo"`
+    TrainType        string              `json:"trainType"`
+    Date             string              `json:"date"`
+    FromStationID    string              `json:"fromStationId"`
+    FromStationCode  string              `json:"fromStationCode"`
+    FromStationName  string              `json:"fromStationName"`
+    ToStationID      string              `json:"toStationId"`
+    ToStationCode    string              `json:"toStationCode"`
+    ToStationName    string              `json:"toStationName"`
+    DepartTime       string              `json:"departTime"`
+    ArriveTime       string              `json:"arriveTime"`
+    SeatType         string              `json:"seatType"`
+    HoldQuantity     int                 `json:"holdQuantity"`
+    PriceCents       int                 `json:"priceCents"`
+    TotalCents       int                 `json:"totalCents"`
+    Currency         string              `json:"currency"`
+    CreatedAt        time.Time           `json:"createdAt"`
+    ExpiresAt        time.Time           `json:"expiresAt"`
+    RemainingSeconds int                 `json:"remainingSeconds"`
+    Passengers       []preorderPassenger `json:"passengers" gorm:"-"`
+}
+
+const preorderSelect = `SELECT p.id,
+           CASE WHEN p.status = 'active' AND p.expires_at <= now() THEN 'expired' ELSE p.status::text END AS status,
+           ts.train_no, t.train_type::text AS train_type, to_char(ts.service_date, 'YYYY-MM-DD') AS date,
+           p.from_station_id, fs.code AS from_station_code, fs.name_en AS from_station_name,
+           p.to_station_id, tst.code AS to_station_code, tst.name_en AS to_station_name,
+           to_char(seg.depart_time, 'HH24:MI') AS depart_time, to_char(seg.arrive_time, 'HH24:MI') AS arrive_time,
+           p.seat_type::text AS seat_type, p.hold_quantity, inv.price_cents,
+           inv.price_cents * (p.hold_quantity - pp.n) + pp.cents AS total_cents, inv.currency,
+           p.created_at, p.expires_at,
+           CASE WHEN p.status = 'active' THEN GREATEST(0, ceil(extract(epoch FROM p.expires_at - now())))::int ELSE 0 END AS remaining_seconds
+    FROM preorders p
+    JOIN train_services ts ON ts.id = p.train_service_id
+    JOIN trains t ON t.train_no = ts.train_no
+    JOIN service_segments seg ON seg.id = p.segment_id
+    JOIN segment_seat_inventory inv ON inv.segment_id = p.segment_id AND inv.seat_type = p.seat_type
+    JOIN stations fs ON fs.id = p.from_station_id
+    JOIN stations tst ON tst.id = p.to_station_id
+    CROSS JOIN LATERAL (SELECT count(*)::int AS n, COALESCE(sum(ticket_price_cents(inv.price_cents, pp.ticket_type)), 0)::int AS cents
+                        FROM preorder_passengers pp WHERE pp.preorder_id = p.id) pp`
+
 func (s *Server) preorderRoutes(g *gin.RouterGroup) {
-    g.POST("/preorders", s.createPreorder)
+    pg := g.Group("/preorders", s.RequireScope(scopeBooking))
+    pg.GET("", s.listPreorders)
+    pg.POST("", s.Idempotent(), s.createPreorder)
+    pg.GET("/:id", s.getPreorder)
+    pg.POST("/:id/cancel", s.cancelPreorder)
 }
 
-func (s *Server) createPreorder(c *gin.Context) {
-    sid, err := c.Cookie("sid")
-    if err != nil || sid == "" {
-        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"login required"})
+func (s *Server) listPreorders(c *gin.Context) {
+    user := currentUser(c)
+    q := preorderSelect + " WHERE p.user_id = ?"
+    args := []any{user.ID}
+    if status := c.Query("status"); status != "" {
+        if !contains(preorderStatuses, status) {
+            c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad query","details": fieldErrors{"status": "must be one of active, expired, canceled, converted"}})
+            return
+        }
+        q = "SELECT * FROM (" + q + ") po WHERE po.status = ?"
+        args = append(args, status)
+    }
+    items := []preorderItem{}
+    err := s.DB.Raw(q+" ORDER BY created_at DESC", args...).Scan(&items).Error
+    if err == nil {
+        err = s.attachPreorderPassengers(items)
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load preorders"})
         return
     }
-    var sess struct{ UserID string }
-    s.DB.Raw("SELECT user_id FROM sessions WHERE sid = ? AND (revoked_at IS NULL) AND expires_at > now()", sid).Scan(&sess)
-    if sess.UserID == "" {
-        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"invalid session"})
+    c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (s *Server) loadPreorder(userID, id string) (preorderItem, error) {
+    items := []preorderItem{}
+    err := s.DB.Raw(preorderSelect+" WHERE p.user_id = ? AND p.id::text = ?", userID, id).Scan(&items).Error
+    if err != nil || len(items) == 0 {
+        return preorderItem{}, err
+    }
+    return items[0], s.attachPreorderPassengers(items)
+}
+
+// attachPreorderPassengers loads the travellers of all items in one query.
+func (s *Server) attachPreorderPassengers(items []preorderItem) error {
+    if len(items) == 0 {
+        return nil
+    }
+    ids := make([]string, len(items))
+    for i, it := range items {
+        ids[i] = it.ID
+    }
+    var rows []preorderPassenger
+    if err := s.DB.Raw(`SELECT pp.preorder_id, pp.passenger_id, pp.name, pp.document_type::text AS document_type, pp.document_number,
+                               pp.ticket_type::text AS ticket_type, ticket_price_cents(inv.price_cents, pp.ticket_type) AS price_cents
+                        FROM preorder_passengers pp
+                        JOIN preorders p ON p.id = pp.preorder_id
+                        JOIN segment_seat_inventory inv ON inv.segment_id = p.segment_id AND inv.seat_type = p.seat_type
+                        WHERE pp.preorder_id IN ? ORDER BY pp.id`, ids).Scan(&rows).Error; err != nil {
+        return err
+    }
+    byPreorder := map[string][]preorderPassenger{}
+    for _, r := range rows {
+        byPreorder[r.PreorderID] = append(byPreorder[r.PreorderID], r)
+    }
+    for i := range items {
+        items[i].Passengers = byPreorder[items[i].ID]
+        if items[i].Passengers == nil {
+            items[i].Passengers = []preorderPassenger{}
+        }
+    }
+    return nil
+}
+
+// resolvePreorderPassengers checks the requested travellers against the
+// user's saved passengers: each may appear once, must hold a document that
+// is valid on the travel date and must be eligible for the ticket type on
+// that date.
+func (s *Server) resolvePreorderPassengers(userID string, reqs []preorderPassengerReq, travel time.Time) ([]preorderPassenger, fieldErrors, error) {
+    errs := fieldErrors{}
+    if len(reqs) == 0 {
+        return nil, errs, nil
+    }
+    if len(reqs) > maxPreorderPassengers {
+        errs.add("passengers", fmt.Sprintf("at most %d passengers per booking", maxPreorderPassengers))
+        return nil, errs, nil
+    }
+    ids := make([]string, len(reqs))
+    for i, r := range reqs {
+        ids[i] = r.PassengerID
+    }
+    var saved []struct {
+        ID                     string
+        Name                   string
+        DocumentType           string
+        DocumentNumber         string
+        DateOfBirth            time.Time
+        DocumentExpirationDate *time.Time
+        VerificationStatus     string
+    }
+    if err := s.DB.Raw(`SELECT id, name, document_type::text AS document_type, document_number, date_of_birth, document_expiration_date,
+                               verification_status::text AS verification_status
+                        FROM passengers WHERE user_id = ? AND id::text IN ?`, userID, ids).Scan(&saved).Error; err != nil {
+        return nil, nil, err
+    }
+    out := make([]preorderPassenger, 0, len(reqs))
+    seen := map[string]bool{}
+    for i, r := range reqs {
+        field := fmt.Sprintf("passengers[%d]", i)
+        ticketType := r.TicketType
+        if ticketType == "" {
+            ticketType = ticketAdult
+        }
+        found := -1
+        for j := range saved {
+            if saved[j].ID == r.PassengerID {
+                found = j
+            }
+        }
+        switch {
+        case r.PassengerID == "":
+            errs.add(field+".passengerId", "required")
+        case found < 0:
+            errs.add(field+".passengerId", "passenger not found")
+        case seen[r.PassengerID]:
+            errs.add(field+".passengerId", "listed more than once")
+        }
+        seen[r.PassengerID] = true
+        if found < 0 {
+            continue
+        }
+        p := saved[found]
+        if p.VerificationStatus == "rejected" {
+            errs.add(field+".passengerId", "the passenger's document failed verification")
+        } else if p.DocumentExpirationDate != nil && validation.CheckExpiry(*p.DocumentExpirationDate, travel) != nil {
+            errs.add(field+".passengerId", "the passenger's document expires before the travel date")
+        }
+        if !contains(eligibleTicketTypes(p.DateOfBirth, travel), ticketType) {
+            errs.add(field+".ticketType", "passenger is not eligible for this ticket type")
+        }
+        id := p.ID
+        out = append(out, preorderPassenger{PassengerID: &id, Name: p.Name, DocumentType: p.DocumentType,
+            DocumentNumber: p.DocumentNumber, TicketType: ticketType})
+    }
+    return out, errs, nil
+}
+
+// getPreorder answers 404 for preorders of other users as well, so ids
+// cannot be probed.
+func (s *Server) getPreorder(c *gin.Context) {
+    item, err := s.loadPreorder(currentUser(c).ID, c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load preorder"})
+        return
+    }
+    if item.ID == "" {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"preorder not found"})
+        return
+    }
+    c.JSON(http.StatusOK, item)
+}
+
+// cancelPreorder gives the held seats back; trg_preorder_release does the
+// inventory update. Only active holds can be canceled.
+func (s *Server) cancelPreorder(c *gin.Context) {
+    user := currentUser(c)
+    res := s.DB.Exec("UPDATE preorders SET status = 'canceled' WHERE id::text = ? AND user_id = ? AND status = 'active'", c.Param("id"), user.ID)
+    if res.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not cancel preorder"})
+        return
+    }
+    item, err := s.loadPreorder(user.ID, c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load preorder"})
+        return
+    }
+    if item.ID == "" {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"preorder not found"})
+        return
+    }
+    if res.RowsAffected == 0 {
+        c.JSON(http.StatusConflict, gin.H{"code":"preorder_not_active","message":"Only active preorders can be canceled","details": gin.H{"status": item.Status}})
+        return
+    }
+    c.JSON(http.StatusOK, item)
+}
+
+func (s *Server) createPreorder(c *gin.Context) {
+    user := currentUser(c)
+    if user.Status == statusPending {
+        c.JSON(http.StatusForbidden, gin.H{"code":"email_unverified","message":"Please verify your email address before booking"})
         return
     }
 
@@ -38,26 +312,79 @@ func (s *Server) createPreorder(c *gin.Context) {
         return
     }
 
+    travel, msg := parseTravelDate(req.Date, time.Now())
+    if msg != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request","details": fieldErrors{"date": msg}})
+        return
+    }
     var svcID int64
-    s.DB.Raw("SELECT id FROM train_services WHERE train_no = ? AND service_date = ? LIMIT 1", req.TrainNo, req.Date).Scan(&svcID)
+    if err := s.DB.Raw("SELECT id FROM train_services WHERE train_no = ? AND service_date = ? LIMIT 1", req.TrainNo, travel.Format("2006-01-02")).Scan(&svcID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create preorder"})
+        return
+    }
     if svcID == 0 {
         c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"train service not found"})
         return
     }
     var segID int64
-    s.DB.Raw("SELECT id FROM service_segments WHERE train_service_id = ? AND from_station_id = ? AND to_station_id = ? LIMIT 1", svcID, req.FromStationId, req.ToStationId).Scan(&segID)
+    if err := s.DB.Raw("SELECT id FROM service_segments WHERE train_service_id = ? AND from_station_id::text = ? AND to_station_id::text = ? LIMIT 1",
+        svcID, req.FromStationId, req.ToStationId).Scan(&segID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create preorder"})
+        return
+    }
     if segID == 0 {
         c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"segment not found"})
         return
     }
 
+    var sold int
+    if err := s.DB.Raw("SELECT count(*) FROM segment_seat_inventory WHERE segment_id = ? AND seat_type::text = ?", segID, req.SeatType).Scan(&sold).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create preorder"})
+        return
+    }
+    if sold == 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request","details": fieldErrors{"seatType": "not sold on this segment"}})
+        return
+    }
+    passengers, errs, err := s.resolvePreorderPassengers(user.ID, req.Passengers, travel)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create preorder"})
+        return
+    }
+    if len(errs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid passengers","details": errs})
+        return
+    }
+    quantity := len(passengers)
+    if quantity == 0 {
+        quantity = 1
+    }
+
     var preorderID string
     expires := time.Now().Add(15 * time.Minute)
-    // hold one seat; trigger handles inventory
-    if err := s.DB.Raw(`INSERT INTO preorders(user_id,train_service_id,from_station_id,to_station_id,segment_id,seat_type,hold_quantity,expires_at)
-                        VALUES (?,?,?,?,?,?,1,?) RETURNING id`, sess.UserID, svcID, req.FromStationId, req.ToStationId, segID, req.SeatType, expires).Scan(&preorderID).Error; err != nil {
+    // one insert holds every seat; the trigger refuses it whole with a
+    // seat_inventory check violation if the class cannot seat the group
+    err = s.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Raw(`INSERT INTO preorders(user_id,train_service_id,from_station_id,to_station_id,segment_id,seat_type,hold_quantity,expires_at)
+                          VALUES (?,?,?,?,?,?,?,?) RETURNING id`, user.ID, svcID, req.FromStationId, req.ToStationId, segID, req.SeatType, quantity, expires).Scan(&preorderID).Error; err != nil {
+            return err
+        }
+        for _, p := range passengers {
+            if err := tx.Exec(`INSERT INTO preorder_passengers(preorder_id, passenger_id, name, document_type, document_number, ticket_type)
+                               VALUES (?, ?, ?, ?, ?, ?)`, preorderID, p.PassengerID, p.Name, p.DocumentType, p.DocumentNumber, p.TicketType).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if checkViolation(err, "seat_inventory") {
         c.JSON(http.StatusConflict, gin.H{"code":"conflict","message":"not enough seats"})
         return
     }
-    c.JSON(http.StatusCreated, gin.H{"preorderId": preorderID, "expiresAt": expires})
+    if err != nil {
+        log.Printf("create preorder for %s: %v", user.ID, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not create preorder"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"preorderId": preorderID, "expiresAt": expires, "holdQuantity": quantity})
 }
\ No newline at end of file
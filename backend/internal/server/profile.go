@@ -0,0 +1,288 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "cs3604/backend/internal/notify"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// profile is the account as shown to its owner.
+type profile struct {
+    ID                     string     `json:"id"`
+    Username               string     `json:"username"`
+    Email                  *string    `json:"email"`
+    Mobile                 *string    `json:"mobile"`
+    Name                   *string    `json:"name"`
+    Nationality            *string    `json:"nationality"`
+    PassportNumber         *string    `json:"passportNumber"`
+    PassportExpirationDate *string    `json:"passportExpirationDate"`
+    DateOfBirth            *string    `json:"dateOfBirth"`
+    Gender                 *string    `json:"gender"`
+    Status                 string     `json:"status"`
+    LastLoginAt            *time.Time `json:"lastLoginAt"`
+    CreatedAt              time.Time  `json:"createdAt"`
+}
+
+// profilePatch holds the editable identity fields; absent fields are kept.
+type profilePatch struct {
+    Nationality            *string `json:"nationality"`
+    Name                   *string `json:"name"`
+    PassportNumber         *string `json:"passportNumber"`
+    PassportExpirationDate *string `json:"passportExpirationDate"`
+    DateOfBirth            *string `json:"dateOfBirth"`
+    Gender                 *string `json:"gender"`
+}
+
+type changePasswordRequest struct {
+    CurrentPassword string `json:"currentPassword"`
+    NewPassword     string `json:"newPassword"`
+}
+
+type changeEmailRequest struct {
+    Email    string `json:"email"`
+    Password string `json:"password"`
+}
+
+func (s *Server) profileRoutes(g *gin.RouterGroup) {
+    me := g.Group("/users/me", s.RequireSession())
+    me.GET("", s.getProfile)
+    me.PATCH("", s.updateProfile)
+    me.POST("/password", s.changePassword)
+    me.POST("/email", s.requestEmailChange)
+    // the link may be opened in another browser, so no session is needed
+    g.POST("/auth/email/confirm", s.confirmEmailChange)
+}
+
+func (s *Server) loadProfile(userID string) (profile, error) {
+    var p profile
+    err := s.DB.Raw(`SELECT id, username, email, mobile, name, nationality, passport_number,
+                            to_char(passport_expiration_date, 'YYYY-MM-DD') AS passport_expiration_date,
+                            to_char(date_of_birth, 'YYYY-MM-DD') AS date_of_birth,
+                            gender::text AS gender, status, last_login_at, created_at
+                     FROM users WHERE id = ?`, userID).Scan(&p).Error
+    return p, err
+}
+
+func (s *Server) getProfile(c *gin.Context) {
+    p, err := s.loadProfile(currentUser(c).ID)
+    if err != nil || p.ID == "" {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not load profile"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"user": p})
+}
+
+func deref(v *string) string {
+    if v == nil {
+        return ""
+    }
+    return *v
+}
+
+// updateProfile applies a partial update using the registration rules. Only
+// fields present in the request are validated and written, so a stored value
+// that has since become invalid (an expired passport) does not block edits to
+// other fields.
+func (s *Server) updateProfile(c *gin.Context) {
+    user := currentUser(c)
+    var req profilePatch
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    in := identity{}
+    present := map[string]*string{
+        "nationality": req.Nationality, "name": req.Name, "passportNumber": req.PassportNumber,
+        "passportExpirationDate": req.PassportExpirationDate, "dateOfBirth": req.DateOfBirth, "gender": req.Gender,
+    }
+    in.Nationality, in.Name, in.PassportNumber = deref(req.Nationality), deref(req.Name), deref(req.PassportNumber)
+    in.PassportExpirationDate, in.DateOfBirth, in.Gender = deref(req.PassportExpirationDate), deref(req.DateOfBirth), deref(req.Gender)
+    // the passport format depends on the nationality, so a change to either
+    // one is checked against the stored value of the other
+    if (req.Nationality == nil) != (req.PassportNumber == nil) {
+        cur, err := s.loadProfile(user.ID)
+        if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not update profile"})
+            return
+        }
+        if req.Nationality == nil && cur.Nationality != nil {
+            in.Nationality, present["nationality"] = *cur.Nationality, cur.Nationality
+        }
+        if req.PassportNumber == nil && cur.PassportNumber != nil {
+            in.PassportNumber, present["passportNumber"] = *cur.PassportNumber, cur.PassportNumber
+        }
+    }
+    all := fieldErrors{}
+    v := validateIdentity(all, in, time.Now())
+    errs := fieldErrors{}
+    for field, reason := range all {
+        if present[field] != nil {
+            errs[field] = reason
+        }
+    }
+    if len(errs) > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid profile data","details": errs})
+        return
+    }
+    // nil arguments leave the column unchanged
+    pick := func(field string, value any) any {
+        if present[field] == nil {
+            return nil
+        }
+        return value
+    }
+    err := s.DB.Exec(`UPDATE users SET nationality = COALESCE(?, nationality), name = COALESCE(?, name),
+                             passport_number = COALESCE(?, passport_number),
+                             passport_expiration_date = COALESCE(?, passport_expiration_date),
+                             date_of_birth = COALESCE(?, date_of_birth),
+                             gender = COALESCE(CAST(? AS gender_enum), gender), updated_at = now()
+                      WHERE id = ?`,
+        pick("nationality", v.Nationality), pick("name", v.Name), pick("passportNumber", v.PassportNumber),
+        pick("passportExpirationDate", v.PassportExpiration), pick("dateOfBirth", v.Birth), pick("gender", v.Gender), user.ID).Error
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not update profile"})
+        return
+    }
+    if err := s.syncSelfPassenger(user.ID); err != nil {
+        log.Printf("sync self passenger for %s: %v", user.ID, err)
+    }
+    s.getProfile(c)
+}
+
+// changePassword requires the current password and signs out every other
+// session; the one making the change stays signed in.
+func (s *Server) changePassword(c *gin.Context) {
+    user := currentUser(c)
+    var req changePasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var current string
+    s.DB.Raw("SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&current)
+    if !s.checkPassword(user.ID, current, req.CurrentPassword) {
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
+        return
+    }
+    if reason := validatePassword(req.NewPassword, user.Username); reason != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Password is too weak","details": fieldErrors{"newPassword": reason}})
+        return
+    }
+    hash, err := s.Passwords.Hash(req.NewPassword)
+    if err == nil {
+        err = s.DB.Transaction(func(tx *gorm.DB) error {
+            if err := tx.Exec("UPDATE users SET password_hash = ?, updated_at = now() WHERE id = ?", hash, user.ID).Error; err != nil {
+                return err
+            }
+            return tx.Exec("UPDATE sessions SET revoked_at = now() WHERE user_id = ? AND sid <> ? AND revoked_at IS NULL", user.ID, user.SID).Error
+        })
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not change password"})
+        return
+    }
+    s.recordLoginEvent(c, user.ID, "", eventSessionRevoked, outcomeSuccess, "password_changed")
+    c.Status(http.StatusNoContent)
+}
+
+// requestEmailChange mails a confirmation link to the new address; the
+// account keeps its old address until the link is used.
+func (s *Server) requestEmailChange(c *gin.Context) {
+    user := currentUser(c)
+    var req changeEmailRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    email := strings.TrimSpace(req.Email)
+    if reason := validateEmail(email); reason != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Invalid email address","details": fieldErrors{"email": reason}})
+        return
+    }
+    var current string
+    s.DB.Raw("SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&current)
+    if !s.checkPassword(user.ID, current, req.Password) {
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
+        return
+    }
+    var taken int
+    s.DB.Raw("SELECT count(*) FROM users WHERE email = ?", email).Scan(&taken)
+    if taken > 0 {
+        c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages["email"],"details": fieldErrors{"email": "already taken"}})
+        return
+    }
+    // the same per-account limit as the other token mails, so the account
+    // cannot be used to mail arbitrary addresses
+    if wait := s.tokenMailWait(user.ID, tokenChangeEmail); wait > 0 {
+        c.Header("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+        c.JSON(http.StatusTooManyRequests, gin.H{"code":"rate_limited","message":"Please wait before requesting another email","details": gin.H{"retryAfterSeconds": int(wait.Seconds())+1}})
+        return
+    }
+    token, err := s.issueUserToken(user.ID, tokenChangeEmail, email, s.Auth.EmailVerifyTTL)
+    if err == nil {
+        link := s.Auth.AppBaseURL + "/confirm-email?token=" + url.QueryEscape(token)
+        err = s.Mailer.Send(c.Request.Context(), notify.Message{
+            To:      email,
+            Subject: "Confirm your new 12306 email address",
+            Body:    fmt.Sprintf("Open the link below within %s to start using this address for your 12306 account:\n%s\n\nIf you did not ask for this, you can ignore this email.", s.Auth.EmailVerifyTTL, link),
+        })
+    }
+    if err != nil {
+        log.Printf("email change for %s: %v", user.ID, err)
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not send confirmation email"})
+        return
+    }
+    c.JSON(http.StatusAccepted, gin.H{"message": "A confirmation link has been sent to the new address"})
+}
+
+// confirmEmailChange switches the address and lets the old one know.
+func (s *Server) confirmEmailChange(c *gin.Context) {
+    var req verifyEmailRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var userID, email string
+    var old *string
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        if userID, email, err = consumeUserToken(tx, tokenChangeEmail, req.Token); err != nil || userID == "" {
+            return err
+        }
+        if err := tx.Raw("SELECT email FROM users WHERE id = ? FOR UPDATE", userID).Scan(&old).Error; err != nil {
+            return err
+        }
+        return tx.Exec("UPDATE users SET email = ?, updated_at = now() WHERE id = ?", email, userID).Error
+    })
+    if err != nil {
+        if field, ok := uniqueViolation(err); ok {
+            c.JSON(http.StatusConflict, gin.H{"code":"conflict","message": conflictMessages[field],"details": fieldErrors{field: "already taken"}})
+            return
+        }
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not change email"})
+        return
+    }
+    if userID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_token","message":"Confirmation link is invalid or has expired"})
+        return
+    }
+    if old != nil && *old != "" {
+        err := s.Mailer.Send(c.Request.Context(), notify.Message{
+            To:      *old,
+            Subject: "Your 12306 email address was changed",
+            Body:    fmt.Sprintf("The email address on your 12306 account was changed to %s.\n\nIf you did not make this change, reset your password right away.", email),
+        })
+        if err != nil {
+            log.Printf("email change notice for %s: %v", userID, err)
+        }
+    }
+    c.Status(http.StatusNoContent)
+}
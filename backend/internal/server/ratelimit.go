@@ -0,0 +1,66 @@
+package server
+
+import (
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// rateLimiter is a per-key fixed-window counter kept in process memory.
+type rateLimiter struct {
+    mu     sync.Mutex
+    limit  int
+    window time.Duration
+    hits   map[string]*rateWindow
+}
+
+type rateWindow struct {
+    start time.Time
+    count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+    return &rateLimiter{limit: limit, window: window, hits: map[string]*rateWindow{}}
+}
+
+// allow records a hit for key and reports whether it is within the limit,
+// and if not, how long until the window resets.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if len(l.hits) > 10000 {
+        for k, w := range l.hits {
+            if now.Sub(w.start) >= l.window {
+                delete(l.hits, k)
+            }
+        }
+    }
+    w, ok := l.hits[key]
+    if !ok || now.Sub(w.start) >= l.window {
+        w = &rateWindow{start: now}
+        l.hits[key] = w
+    }
+    w.count++
+    if w.count > l.limit {
+        return false, w.start.Add(l.window).Sub(now)
+    }
+    return true, 0
+}
+
+// RateLimit limits requests per client IP. X-Forwarded-For only counts when
+// the peer is one of Auth.TrustedProxies, so clients cannot pick their key.
+func (s *Server) RateLimit(l *rateLimiter) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        ok, wait := l.allow(c.ClientIP(), time.Now())
+        if !ok {
+            secs := int(wait.Seconds()) + 1
+            c.Header("Retry-After", strconv.Itoa(secs))
+            c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"code":"rate_limited","message":"Too many requests","details": gin.H{"retryAfterSeconds": secs}})
+            return
+        }
+        c.Next()
+    }
+}
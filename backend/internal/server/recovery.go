@@ -0,0 +1,97 @@
+package server
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+
+    "cs3604/backend/internal/notify"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+type forgotPasswordRequest struct {
+    Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+// forgotPasswordPerHour bounds reset requests per client IP.
+const forgotPasswordPerHour = 20
+
+// forgotPassword always answers 202 so that it cannot be used to probe which
+// emails are registered. Like verification emails, at most one reset email
+// per minute and five per hour go to the same account; requests over that
+// are dropped silently for the same reason.
+func (s *Server) forgotPassword(c *gin.Context) {
+    var req forgotPasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"email is required"})
+        return
+    }
+    var user struct{ ID string; Email string }
+    s.DB.Raw("SELECT id, email FROM users WHERE email = ? LIMIT 1", req.Email).Scan(&user)
+    if user.ID != "" && s.tokenMailWait(user.ID, tokenPasswordReset) > 0 {
+        log.Printf("password reset for %s: rate limited", user.ID)
+    } else if user.ID != "" {
+        token, err := s.issueUserToken(user.ID, tokenPasswordReset, "", s.Auth.PasswordResetTTL)
+        if err == nil {
+            link := s.Auth.AppBaseURL + "/reset-password?token=" + url.QueryEscape(token)
+            err = s.Mailer.Send(c.Request.Context(), notify.Message{
+                To:      user.Email,
+                Subject: "Reset your 12306 password",
+                Body: fmt.Sprintf("We received a request to reset your password.\n\nOpen the link below within %s to choose a new one:\n%s\n\nIf you did not ask for this, you can ignore this email.",
+                    s.Auth.PasswordResetTTL, link),
+            })
+        }
+        if err != nil {
+            log.Printf("password reset for %s: %v", user.ID, err)
+        }
+    }
+    c.JSON(http.StatusAccepted, gin.H{"message": "If the email is registered, a reset link has been sent"})
+}
+
+// resetPassword consumes a reset token, sets the new password and signs the
+// user out everywhere.
+func (s *Server) resetPassword(c *gin.Context) {
+    var req resetPasswordRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    if reason := validatePassword(req.Password, ""); reason != "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"Password is too weak","details": fieldErrors{"password": reason}})
+        return
+    }
+    hash, err := s.Passwords.Hash(req.Password)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not reset password"})
+        return
+    }
+    var userID string
+    err = s.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        if userID, _, err = consumeUserToken(tx, tokenPasswordReset, req.Token); err != nil || userID == "" {
+            return err
+        }
+        if err := tx.Exec("UPDATE users SET password_hash = ?, updated_at = now() WHERE id = ?", hash, userID).Error; err != nil {
+            return err
+        }
+        return tx.Exec("UPDATE sessions SET revoked_at = now() WHERE user_id = ? AND revoked_at IS NULL", userID).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not reset password"})
+        return
+    }
+    if userID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_token","message":"Reset link is invalid or has expired"})
+        return
+    }
+    s.recordLoginEvent(c, userID, "", eventSessionRevoked, outcomeSuccess, "password_reset")
+    c.Status(http.StatusNoContent)
+}
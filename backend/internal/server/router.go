@@ -1,21 +1,43 @@
 package server
 
 import (
+    "log"
     "net/http"
     "os"
 
+    "cs3604/backend/internal/config"
+    "cs3604/backend/internal/notify"
+    "cs3604/backend/internal/oidc"
+    "cs3604/backend/internal/orders"
+    "cs3604/backend/internal/password"
+
     "github.com/gin-contrib/cors"
     "github.com/gin-gonic/gin"
     "gorm.io/gorm"
 )
 
 type Server struct {
-	R  *gin.Engine
-	DB *gorm.DB
+	R         *gin.Engine
+	DB        *gorm.DB
+	Auth      config.AuthConfig
+	Mailer    notify.Mailer
+	SMS       notify.SMSSender
+	Passwords password.Hasher
+	SeedDir   string
+	Orders    *orders.Service
+	// OIDC is nil unless an external identity provider is configured.
+	OIDC *oidc.Provider
 }
 
 func New(db *gorm.DB) *Server {
     r := gin.Default()
+    auth := config.LoadAuth()
+    // login throttling and rate limits key on c.ClientIP(), so forwarded
+    // headers are only believed from configured proxies
+    if err := r.SetTrustedProxies(auth.TrustedProxies); err != nil {
+        log.Printf("ignoring TRUSTED_PROXIES: %v", err)
+        r.SetTrustedProxies(nil)
+    }
     origin := os.Getenv("DEV_FRONTEND_ORIGIN")
     if origin == "" {
         origin = "http://localhost:5173"
@@ -23,28 +45,38 @@ func New(db *gorm.DB) *Server {
     r.Use(cors.New(cors.Config{
         AllowOrigins:     []string{origin},
         AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-        AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-        ExposeHeaders:    []string{"Content-Length"},
+        AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", csrfHeader, idempotencyHeader},
+        ExposeHeaders:    []string{"Content-Length", idempotencyReplayedHeader},
         AllowCredentials: true,
     }))
-    s := &Server{R: r, DB: db}
+    s := &Server{R: r, DB: db, Auth: auth, Mailer: notify.NewMailer(config.LoadMail()), SMS: notify.NewSMSSender(config.LoadSMS()),
+        Passwords: password.New(config.LoadPassword()), SeedDir: config.LoadSeed().Dir, Orders: orders.New(db)}
+    if cfg := config.LoadOIDC(); cfg.Issuer != "" {
+        s.OIDC = oidc.New(oidc.Config{Issuer: cfg.Issuer, ClientID: cfg.ClientID, ClientSecret: cfg.ClientSecret, RedirectURL: cfg.RedirectURL,
+            LinkByEmail: cfg.LinkByEmail})
+    }
     s.routes()
     return s
 }
 
 func (s *Server) routes() {
 	v1 := s.R.Group("/api/v1")
+	v1.Use(s.OptionalSession(), s.CSRF())
 	s.authRoutes(v1)
+	s.sessionRoutes(v1)
+	s.otpRoutes(v1)
+	s.twoFactorRoutes(v1)
+	s.oidcRoutes(v1)
+	s.apiTokenRoutes(v1)
+	s.profileRoutes(v1)
+	s.accountRoutes(v1)
+	s.passengerRoutes(v1)
 	v1.GET("/dictionaries", s.getDictionaries)
-	v1.GET("/stations", s.searchStations)
+	v1.GET("/stations", s.TokenScope(scopeSearch), s.searchStations)
 	s.trainsRoutes(v1)
 	s.preorderRoutes(v1)
-
-    // daily job endpoint (optional manual trigger)
-    s.R.POST("/internal/jobs/rolling14", func(c *gin.Context){
-        s.DB.Exec("SELECT ensure_rolling_14_days()")
-        c.JSON(http.StatusOK, gin.H{"ok": true})
-    })
+	s.orderRoutes(v1)
+	s.adminRoutes(v1)
 }
 
 func (s *Server) getDictionaries(c *gin.Context) {
@@ -52,7 +84,7 @@ func (s *Server) getDictionaries(c *gin.Context) {
 		"trainTypes":    []string{"G", "D", "C", "Z", "T", "K"},
 		"seatTypes":     []string{"business", "first", "second", "softSleeper", "hardSleeper", "hardSeat"},
 		"ticketTypes":   []string{"adult", "child", "student"},
-		"dateRangeDays": 14,
+		"dateRangeDays": bookingRangeDays,
 	})
 }
 
@@ -2,15 +2,32 @@ package server
 
 import (
     "bytes"
+    "context"
     "encoding/json"
+    "fmt"
+    "math"
     "net/http"
     "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
     "testing"
     "time"
 
     "cs3604/backend/internal/config"
     "cs3604/backend/internal/db"
+    "cs3604/backend/internal/notify"
+    "cs3604/backend/internal/oidc"
+    "cs3604/backend/internal/oidc/oidctest"
+    "cs3604/backend/internal/orders"
+    "cs3604/backend/internal/password"
     "cs3604/backend/internal/repo"
+    "cs3604/backend/internal/totp"
+    "github.com/gin-gonic/gin"
     "github.com/stretchr/testify/require"
 )
 
@@ -18,7 +35,28 @@ func newTestServer(t *testing.T) (*Server, *repo.Repo) {
     cfg := config.LoadDB()
     gdb, err := db.Open(cfg.DSN())
     require.NoError(t, err)
-    return New(gdb), repo.New(gdb)
+    s := New(gdb)
+    s.Mailer = &notify.FileMailer{Dir: t.TempDir()}
+    return s, repo.New(gdb)
+}
+
+// lastMailToken returns the token embedded in the newest email sent to addr.
+func lastMailToken(t *testing.T, s *Server, addr string) string {
+    dir := s.Mailer.(*notify.FileMailer).Dir
+    entries, err := os.ReadDir(dir)
+    require.NoError(t, err)
+    for i := len(entries) - 1; i >= 0; i-- {
+        raw, err := os.ReadFile(filepath.Join(dir, entries[i].Name()))
+        require.NoError(t, err)
+        if !strings.Contains(string(raw), "To: "+addr+"\r\n") {
+            continue
+        }
+        m := regexp.MustCompile(`token=([A-Za-z0-9_-]+)`).FindStringSubmatch(string(raw))
+        require.NotNil(t, m)
+        return m[1]
+    }
+    t.Fatalf("no mail sent to %s", addr)
+    return ""
 }
 
 func TestAPI_DictionariesAndStations(t *testing.T) {
@@ -40,7 +78,7 @@ func TestAPI_Auth_Register_Login_Session_Logout(t *testing.T) {
     reg := map[string]any{
         "nationality": "CN",
         "name": "Test User",
-        "passportNumber": "P1234567",
+        "passportNumber": "E12345678",
         "passportExpirationDate": time.Now().AddDate(5,0,0).Format("2006-01-02"),
         "dateOfBirth": time.Now().AddDate(-30,0,0).Format("2006-01-02"),
         "gender": "male",
@@ -55,6 +93,7 @@ func TestAPI_Auth_Register_Login_Session_Logout(t *testing.T) {
     req.Header.Set("Content-Type", "application/json")
     s.R.ServeHTTP(w, req)
     require.Equal(t, http.StatusCreated, w.Code)
+    verifyEmail(t, s, reg["email"].(string))
 
     // login
     login := map[string]any{"identifier": reg["username"], "password": reg["password"]}
@@ -79,6 +118,7 @@ func TestAPI_Auth_Register_Login_Session_Logout(t *testing.T) {
     w4 := httptest.NewRecorder()
     req4 := httptest.NewRequest(http.MethodPost, "/api/v1/auth/logout", nil)
     req4.Header.Set("Cookie", setCookie)
+    withCSRF(t, s, req4)
     s.R.ServeHTTP(w4, req4)
     require.Equal(t, http.StatusNoContent, w4.Code)
 
@@ -94,7 +134,9 @@ func TestAPI_TrainsSearchAndPreorder(t *testing.T) {
     s, r := newTestServer(t)
     // ensure rolling 14 days in DB
     wj := httptest.NewRecorder()
-    rj := httptest.NewRequest(http.MethodPost, "/internal/jobs/rolling14", nil)
+    rj := httptest.NewRequest(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil)
+    rj.AddCookie(adminSession(t, s))
+    withCSRF(t, s, rj)
     s.R.ServeHTTP(wj, rj)
     require.Equal(t, http.StatusOK, wj.Code)
     // pick stations via repo to avoid hard-coded IDs
@@ -116,7 +158,7 @@ func TestAPI_TrainsSearchAndPreorder(t *testing.T) {
 
     // register + login to create preorder
     reg := map[string]any{
-        "nationality": "CN", "name": "Test User", "passportNumber": "P1234567",
+        "nationality": "CN", "name": "Test User", "passportNumber": "E12345678",
         "passportExpirationDate": time.Now().AddDate(5,0,0).Format("2006-01-02"),
         "dateOfBirth": time.Now().AddDate(-30,0,0).Format("2006-01-02"),
         "gender": "male",
@@ -130,6 +172,7 @@ func TestAPI_TrainsSearchAndPreorder(t *testing.T) {
     rr.Header.Set("Content-Type", "application/json")
     s.R.ServeHTTP(wr, rr)
     require.Equal(t, http.StatusCreated, wr.Code)
+    verifyEmail(t, s, reg["email"].(string))
 
     bodyLogin, _ := json.Marshal(map[string]any{"identifier": reg["username"], "password": reg["password"]})
     wl := httptest.NewRecorder()
@@ -159,6 +202,7 @@ func TestAPI_TrainsSearchAndPreorder(t *testing.T) {
     rp := httptest.NewRequest(http.MethodPost, "/api/v1/preorders", bytes.NewReader(bodyPO))
     rp.Header.Set("Content-Type", "application/json")
     rp.Header.Set("Cookie", cookie)
+    withCSRF(t, s, rp)
     s.R.ServeHTTP(wp, rp)
     require.Equal(t, http.StatusCreated, wp.Code)
 
@@ -168,4 +212,1740 @@ func TestAPI_TrainsSearchAndPreorder(t *testing.T) {
     rpu.Header.Set("Content-Type", "application/json")
     s.R.ServeHTTP(wpu, rpu)
     require.Equal(t, http.StatusUnauthorized, wpu.Code)
-}
\ No newline at end of file
+}
+func TestAPI_SessionMiddleware_RejectsRevokedAndExpired(t *testing.T) {
+    s, r := newTestServer(t)
+    uid, err := r.CreateUser("mw_"+time.Now().Format("150405"), "mw_"+time.Now().Format("150405")+"@example.com", "dummyhash")
+    require.NoError(t, err)
+    defer r.DeleteUser(uid)
+
+    sid, err := r.CreateSession(uid, time.Now().Add(time.Hour))
+    require.NoError(t, err)
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req.Header.Set("Cookie", "sid="+sid)
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusOK, w.Code)
+
+    require.NoError(t, r.RevokeSession(sid))
+    w2 := httptest.NewRecorder()
+    req2 := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req2.Header.Set("Cookie", "sid="+sid)
+    s.R.ServeHTTP(w2, req2)
+    require.Equal(t, http.StatusUnauthorized, w2.Code)
+
+    expired, err := r.CreateSession(uid, time.Now().Add(-time.Minute))
+    require.NoError(t, err)
+    w3 := httptest.NewRecorder()
+    req3 := httptest.NewRequest(http.MethodPost, "/api/v1/preorders", bytes.NewReader([]byte(`{}`)))
+    req3.Header.Set("Content-Type", "application/json")
+    req3.Header.Set("Cookie", "sid="+expired)
+    s.R.ServeHTTP(w3, req3)
+    require.Equal(t, http.StatusUnauthorized, w3.Code)
+    var body struct{ Code string }
+    require.NoError(t, json.Unmarshal(w3.Body.Bytes(), &body))
+    require.Equal(t, "unauthorized", body.Code)
+}
+
+// registerUser registers a fresh account through the API and returns its request body.
+func registerUser(t *testing.T, s *Server, prefix string) map[string]any {
+    suffix := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+    reg := map[string]any{
+        "nationality": "CN", "name": "Test User", "passportNumber": "E12345678",
+        "passportExpirationDate": time.Now().AddDate(5,0,0).Format("2006-01-02"),
+        "dateOfBirth": time.Now().AddDate(-30,0,0).Format("2006-01-02"),
+        "gender": "male",
+        "username": prefix+"_"+suffix,
+        "password": "Passw0rd!", "email": prefix+"_"+suffix+"@example.com",
+        "agreeTerms": true,
+    }
+    body, _ := json.Marshal(reg)
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register", bytes.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusCreated, w.Code)
+    verifyEmail(t, s, reg["email"].(string))
+    return reg
+}
+
+// verifyEmail confirms the address using the link from the verification email.
+func verifyEmail(t *testing.T, s *Server, addr string) {
+    body, _ := json.Marshal(map[string]any{"token": lastMailToken(t, s, addr)})
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/verify-email", bytes.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusNoContent, w.Code)
+}
+
+// doLogin posts to /auth/login and returns the recorder.
+func doLogin(s *Server, payload map[string]any) *httptest.ResponseRecorder {
+    body, _ := json.Marshal(payload)
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    s.R.ServeHTTP(w, req)
+    return w
+}
+
+// adminSession registers a user, grants it the admin role and logs it in.
+func adminSession(t *testing.T, s *Server) *http.Cookie {
+    reg := registerUser(t, s, "adm")
+    require.NoError(t, s.DB.Exec("UPDATE users SET role = 'admin' WHERE username = ?", reg["username"]).Error)
+    ck := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, ck)
+    return ck
+}
+
+// withCSRF sets the CSRF token of the session named by req's sid cookie.
+func withCSRF(t *testing.T, s *Server, req *http.Request) {
+    ck, err := req.Cookie("sid")
+    require.NoError(t, err)
+    var token string
+    require.NoError(t, s.DB.Raw("SELECT csrf_token FROM sessions WHERE sid = ?", ck.Value).Scan(&token).Error)
+    req.Header.Set(csrfHeader, token)
+}
+
+// responseCookie returns the named cookie set by a response, or nil.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+    for _, ck := range w.Result().Cookies() {
+        if ck.Name == name {
+            return ck
+        }
+    }
+    return nil
+}
+
+func TestAPI_Login_RememberMeAndSlidingExpiry(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "rm")
+
+    // without rememberMe: browser-session cookie and a short idle expiry
+    w := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+    require.Equal(t, http.StatusOK, w.Code)
+    short := responseCookie(w, "sid")
+    require.NotNil(t, short)
+    require.Zero(t, short.MaxAge)
+    var expires time.Time
+    require.NoError(t, s.DB.Raw("SELECT expires_at FROM sessions WHERE sid = ?", short.Value).Scan(&expires).Error)
+    require.WithinDuration(t, time.Now().Add(s.Auth.SessionIdleTTL), expires, time.Minute)
+
+    // with rememberMe: persistent cookie with the long TTL
+    w2 := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"], "rememberMe": true})
+    require.Equal(t, http.StatusOK, w2.Code)
+    long := responseCookie(w2, "sid")
+    require.NotNil(t, long)
+    require.Greater(t, long.MaxAge, int(s.Auth.SessionIdleTTL.Seconds()))
+
+    // activity slides expires_at forward
+    require.NoError(t, s.DB.Exec("UPDATE sessions SET expires_at = now() + interval '2 minutes' WHERE sid = ?", short.Value).Error)
+    w3 := httptest.NewRecorder()
+    req3 := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req3.AddCookie(short)
+    s.R.ServeHTTP(w3, req3)
+    require.Equal(t, http.StatusOK, w3.Code)
+    require.NoError(t, s.DB.Raw("SELECT expires_at FROM sessions WHERE sid = ?", short.Value).Scan(&expires).Error)
+    require.WithinDuration(t, time.Now().Add(s.Auth.SessionIdleTTL), expires, time.Minute)
+
+    // but never past the absolute cap
+    require.NoError(t, s.DB.Exec("UPDATE sessions SET created_at = now() - make_interval(secs => ?), expires_at = now() + interval '1 minute' WHERE sid = ?",
+        (s.Auth.SessionAbsoluteTTL - 2*time.Minute).Seconds(), long.Value).Error)
+    w4 := httptest.NewRecorder()
+    req4 := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req4.AddCookie(long)
+    s.R.ServeHTTP(w4, req4)
+    require.Equal(t, http.StatusOK, w4.Code)
+    require.NoError(t, s.DB.Raw("SELECT expires_at FROM sessions WHERE sid = ?", long.Value).Scan(&expires).Error)
+    require.WithinDuration(t, time.Now().Add(2*time.Minute), expires, 30*time.Second)
+}
+
+func TestAPI_SessionManagement(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "dev")
+    loginFrom := func(ua string) *http.Cookie {
+        body, _ := json.Marshal(map[string]any{"identifier": reg["username"], "password": reg["password"]})
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.Header.Set("User-Agent", ua)
+        s.R.ServeHTTP(w, req)
+        require.Equal(t, http.StatusOK, w.Code)
+        return responseCookie(w, "sid")
+    }
+    laptop := loginFrom("laptop-browser")
+    phone := loginFrom("phone-browser")
+
+    type listResp struct{ Items []struct{ ID string; UserAgent *string; IP *string; Current bool } }
+    list := func(ck *http.Cookie) listResp {
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil)
+        req.AddCookie(ck)
+        s.R.ServeHTTP(w, req)
+        require.Equal(t, http.StatusOK, w.Code)
+        var resp listResp
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return resp
+    }
+    resp := list(laptop)
+    require.Len(t, resp.Items, 2)
+    var currentID string
+    for _, it := range resp.Items {
+        require.NotNil(t, it.UserAgent)
+        require.NotNil(t, it.IP)
+        if it.Current {
+            require.Equal(t, "laptop-browser", *it.UserAgent)
+            currentID = it.ID
+        }
+    }
+    require.NotEmpty(t, currentID)
+
+    // revoke the phone from the laptop
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions/revoke-others", nil)
+    req.AddCookie(laptop)
+    withCSRF(t, s, req)
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusOK, w.Code)
+    w2 := httptest.NewRecorder()
+    req2 := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req2.AddCookie(phone)
+    s.R.ServeHTTP(w2, req2)
+    require.Equal(t, http.StatusUnauthorized, w2.Code)
+    require.Len(t, list(laptop).Items, 1)
+
+    // unknown ids are not found; the current session can be deleted by id
+    w3 := httptest.NewRecorder()
+    req3 := httptest.NewRequest(http.MethodDelete, "/api/v1/sessions/deadbeef", nil)
+    req3.AddCookie(laptop)
+    withCSRF(t, s, req3)
+    s.R.ServeHTTP(w3, req3)
+    require.Equal(t, http.StatusNotFound, w3.Code)
+    w4 := httptest.NewRecorder()
+    req4 := httptest.NewRequest(http.MethodDelete, "/api/v1/sessions/"+currentID, nil)
+    req4.AddCookie(laptop)
+    withCSRF(t, s, req4)
+    s.R.ServeHTTP(w4, req4)
+    require.Equal(t, http.StatusNoContent, w4.Code)
+    w5 := httptest.NewRecorder()
+    req5 := httptest.NewRequest(http.MethodGet, "/api/v1/sessions", nil)
+    req5.AddCookie(laptop)
+    s.R.ServeHTTP(w5, req5)
+    require.Equal(t, http.StatusUnauthorized, w5.Code)
+}
+
+func TestAPI_Login_LockoutAfterRepeatedFailures(t *testing.T) {
+    s, _ := newTestServer(t)
+    s.Auth.LoginDelayAfter = 100
+    s.Auth.LoginLockThreshold = 3
+    reg := registerUser(t, s, "lk")
+    remote := "10.4." + strconv.Itoa(time.Now().Nanosecond()%250) + "." + strconv.Itoa(time.Now().Second()+1) + ":5000"
+    attempt := func(identifier, password string) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(map[string]any{"identifier": identifier, "password": password})
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.RemoteAddr = remote
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+
+    for _, identifier := range []any{reg["username"], "nobody_" + strconv.FormatInt(time.Now().UnixNano(), 10)} {
+        for i := 0; i < 3; i++ {
+            w := attempt(identifier.(string), "wrong-password")
+            require.Equal(t, http.StatusUnauthorized, w.Code)
+            require.Contains(t, w.Body.String(), "Invalid credentials")
+        }
+        // locked now, even with the right password; unknown users look the same
+        w := attempt(identifier.(string), reg["password"].(string))
+        require.Equal(t, http.StatusLocked, w.Code)
+        var body struct{ Code string; Details struct{ RetryAfterSeconds int } }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+        require.Equal(t, "account_locked", body.Code)
+        require.Greater(t, body.Details.RetryAfterSeconds, 0)
+    }
+
+    var failures int
+    require.NoError(t, s.DB.Raw("SELECT count(*) FROM login_attempts WHERE identifier = ? AND success = false", reg["username"]).Scan(&failures).Error)
+    require.Equal(t, 3, failures)
+}
+
+func TestAPI_Login_IPThrottleIgnoresSpoofedForwardedFor(t *testing.T) {
+    s, _ := newTestServer(t)
+    s.Auth.LoginDelayAfter = 100
+    s.Auth.LoginLockThreshold = 100
+    s.Auth.LoginIPThreshold = 3
+    host := "10.5." + strconv.Itoa(time.Now().Nanosecond()%250) + "." + strconv.Itoa(time.Now().Second()+1)
+    attempt := func(i int) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(map[string]any{"identifier": "nobody_" + strconv.FormatInt(time.Now().UnixNano(), 10), "password": "wrong-password"})
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        // a new "client" on every request must not get a fresh bucket
+        req.Header.Set("X-Forwarded-For", "203.0.113."+strconv.Itoa(i+1))
+        req.RemoteAddr = host + ":5000"
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    for i := 0; i < 3; i++ {
+        require.Equal(t, http.StatusUnauthorized, attempt(i).Code)
+    }
+    require.Equal(t, http.StatusTooManyRequests, attempt(3).Code)
+
+    var recorded int
+    require.NoError(t, s.DB.Raw("SELECT count(*) FROM login_attempts WHERE ip = ?", host).Scan(&recorded).Error)
+    require.Equal(t, 3, recorded)
+}
+
+func TestAPI_PasswordReset(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "pr")
+    w := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+    require.Equal(t, http.StatusOK, w.Code)
+    oldSession := responseCookie(w, "sid")
+
+    post := func(path string, payload map[string]any) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    // unknown emails get the same answer
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/password/forgot", map[string]any{"email": "nobody@example.com"}).Code)
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/password/forgot", map[string]any{"email": reg["email"]}).Code)
+    token := lastMailToken(t, s, reg["email"].(string))
+    // a repeat within the minute is accepted but mails nothing
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/password/forgot", map[string]any{"email": reg["email"]}).Code)
+    require.Equal(t, token, lastMailToken(t, s, reg["email"].(string)))
+
+    require.Equal(t, http.StatusNoContent, post("/api/v1/auth/password/reset", map[string]any{"token": token, "password": "N3wPassw0rd"}).Code)
+    // single use
+    require.Equal(t, http.StatusBadRequest, post("/api/v1/auth/password/reset", map[string]any{"token": token, "password": "An0therPass"}).Code)
+
+    // existing sessions are revoked
+    w2 := httptest.NewRecorder()
+    req2 := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    req2.AddCookie(oldSession)
+    s.R.ServeHTTP(w2, req2)
+    require.Equal(t, http.StatusUnauthorized, w2.Code)
+
+    require.Equal(t, http.StatusUnauthorized, doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}).Code)
+    require.Equal(t, http.StatusOK, doLogin(s, map[string]any{"identifier": reg["username"], "password": "N3wPassw0rd"}).Code)
+
+    // one client cannot keep asking for resets
+    for i := 3; i < forgotPasswordPerHour; i++ {
+        require.Equal(t, http.StatusAccepted, post("/api/v1/auth/password/forgot", map[string]any{"email": "nobody@example.com"}).Code)
+    }
+    require.Equal(t, http.StatusTooManyRequests, post("/api/v1/auth/password/forgot", map[string]any{"email": "nobody@example.com"}).Code)
+}
+
+func TestAPI_EmailVerification(t *testing.T) {
+    s, r := newTestServer(t)
+    suffix := strconv.FormatInt(time.Now().UnixNano()%1000000000, 10)
+    reg := map[string]any{
+        "nationality": "CN", "name": "Test User", "passportNumber": "E12345678",
+        "passportExpirationDate": time.Now().AddDate(5,0,0).Format("2006-01-02"),
+        "dateOfBirth": time.Now().AddDate(-30,0,0).Format("2006-01-02"),
+        "gender": "female",
+        "username": "ev_"+suffix, "password": "Passw0rd!", "email": "ev_"+suffix+"@example.com",
+        "agreeTerms": true,
+    }
+    post := func(path string, payload map[string]any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    require.Equal(t, http.StatusCreated, post("/api/v1/auth/register", reg, nil).Code)
+    var status, uid string
+    require.NoError(t, s.DB.Raw("SELECT status FROM users WHERE username = ?", reg["username"]).Scan(&status).Error)
+    require.Equal(t, "pending", status)
+    require.NoError(t, s.DB.Raw("SELECT id FROM users WHERE username = ?", reg["username"]).Scan(&uid).Error)
+
+    // pending accounts cannot sign in or book
+    w := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+    require.Equal(t, http.StatusForbidden, w.Code)
+    require.Contains(t, w.Body.String(), "email_unverified")
+    sid, err := r.CreateSession(uid, time.Now().Add(time.Hour))
+    require.NoError(t, err)
+    wp := post("/api/v1/preorders", map[string]any{}, &http.Cookie{Name: "sid", Value: sid})
+    require.Equal(t, http.StatusForbidden, wp.Code)
+
+    // resend is throttled right after the registration email
+    require.Equal(t, http.StatusTooManyRequests, post("/api/v1/auth/verify-email/resend", map[string]any{"email": reg["email"]}, nil).Code)
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/verify-email/resend", map[string]any{"email": "nobody@example.com"}, nil).Code)
+
+    token := lastMailToken(t, s, reg["email"].(string))
+    require.Equal(t, http.StatusBadRequest, post("/api/v1/auth/verify-email", map[string]any{"token": "bogus"}, nil).Code)
+    require.Equal(t, http.StatusNoContent, post("/api/v1/auth/verify-email", map[string]any{"token": token}, nil).Code)
+    require.Equal(t, http.StatusOK, doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}).Code)
+}
+
+// recordingSMS keeps every text in memory so tests can read codes back.
+type recordingSMS struct {
+    mu   sync.Mutex
+    sent []struct{ To, Text string }
+}
+
+func (r *recordingSMS) SendSMS(ctx context.Context, to, text string) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.sent = append(r.sent, struct{ To, Text string }{to, text})
+    return nil
+}
+
+func (r *recordingSMS) Sent() []struct{ To, Text string } {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]struct{ To, Text string }(nil), r.sent...)
+}
+
+func TestAPI_MobileBindingAndOTPLogin(t *testing.T) {
+    s, _ := newTestServer(t)
+    sms := &recordingSMS{}
+    s.SMS = sms
+    reg := registerUser(t, s, "otp")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    mobile := "13" + strconv.FormatInt(100000000+time.Now().UnixNano()%900000000, 10)
+    // a client address of its own, so the per-IP limit only sees this run
+    host := "10.6." + strconv.Itoa(time.Now().Nanosecond()%250) + "." + strconv.Itoa(time.Now().Second()+1)
+
+    post := func(path string, payload map[string]any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.RemoteAddr = host + ":5000"
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    lastCode := func() string {
+        sent := sms.Sent()
+        require.NotEmpty(t, sent)
+        require.Equal(t, mobile, sent[len(sent)-1].To)
+        return regexp.MustCompile(`\d{6}`).FindString(sent[len(sent)-1].Text)
+    }
+
+    // bind the number
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/users/me/mobile", map[string]any{"mobile": mobile}, nil).Code)
+    require.Equal(t, http.StatusAccepted, post("/api/v1/users/me/mobile", map[string]any{"mobile": mobile}, session).Code)
+    code := lastCode()
+    require.Equal(t, http.StatusBadRequest, post("/api/v1/users/me/mobile/verify", map[string]any{"mobile": mobile, "code": "000000x"}, session).Code)
+    require.Equal(t, http.StatusOK, post("/api/v1/users/me/mobile/verify", map[string]any{"mobile": mobile, "code": code}, session).Code)
+
+    // a fresh code cannot be requested within the resend interval
+    require.Equal(t, http.StatusTooManyRequests, post("/api/v1/auth/otp/request", map[string]any{"mobile": mobile}, nil).Code)
+    require.NoError(t, s.DB.Exec("UPDATE otp_codes SET created_at = created_at - interval '2 minutes' WHERE mobile = ?", mobile).Error)
+
+    // passwordless login with the bound number
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/otp/request", map[string]any{"mobile": mobile}, nil).Code)
+    code = lastCode()
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/otp/login", map[string]any{"mobile": mobile, "code": "999999x"}, nil).Code)
+    w := post("/api/v1/auth/otp/login", map[string]any{"mobile": mobile, "code": code}, nil)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.NotNil(t, responseCookie(w, "sid"))
+    // codes are single use
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/otp/login", map[string]any{"mobile": mobile, "code": code}, nil).Code)
+
+    // unknown numbers get the same answer but no text
+    before := len(sms.Sent())
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/otp/request", map[string]any{"mobile": "19" + mobile[2:]}, nil).Code)
+    require.Len(t, sms.Sent(), before)
+
+    // one client cannot spread requests across numbers past the per-IP cap
+    s.Auth.OTPIPPerHour = 4
+    require.Equal(t, http.StatusAccepted, post("/api/v1/auth/otp/request", map[string]any{"mobile": "18" + mobile[2:]}, nil).Code)
+    w = post("/api/v1/auth/otp/request", map[string]any{"mobile": "17" + mobile[2:]}, nil)
+    require.Equal(t, http.StatusTooManyRequests, w.Code)
+    require.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestAPI_TOTPTwoFactorLogin(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "tf")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    post := func(path string, payload map[string]any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+
+    w := post("/api/v1/users/me/2fa/totp", map[string]any{}, session)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var enroll struct{ Secret string; OtpauthUri string; RecoveryCodes []string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enroll))
+    require.Contains(t, enroll.OtpauthUri, "otpauth://totp/")
+    require.Len(t, enroll.RecoveryCodes, 10)
+    code, err := totp.Code(enroll.Secret, time.Now())
+    require.NoError(t, err)
+    require.Equal(t, http.StatusOK, post("/api/v1/users/me/2fa/totp/confirm", map[string]any{"code": code}, session).Code)
+
+    // password alone now yields a challenge instead of a session
+    challenge := func() string {
+        w := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+        require.Equal(t, http.StatusOK, w.Code)
+        require.Nil(t, responseCookie(w, "sid"))
+        var resp struct{ TwoFactorRequired bool; ChallengeToken string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        require.True(t, resp.TwoFactorRequired)
+        return resp.ChallengeToken
+    }
+    token := challenge()
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": token, "code": "000000"}, nil).Code)
+    next, err := totp.Code(enroll.Secret, time.Now().Add(totp.Period*time.Second))
+    require.NoError(t, err)
+    w2 := post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": token, "code": next}, nil)
+    require.Equal(t, http.StatusOK, w2.Code)
+    require.NotNil(t, responseCookie(w2, "sid"))
+    // the challenge is spent
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": token, "code": next}, nil).Code)
+
+    // recovery codes work once
+    token = challenge()
+    require.Equal(t, http.StatusOK, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": token, "recoveryCode": enroll.RecoveryCodes[0]}, nil).Code)
+    token = challenge()
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": token, "recoveryCode": enroll.RecoveryCodes[0]}, nil).Code)
+
+    // disabling needs the password
+    require.Equal(t, http.StatusUnauthorized, post("/api/v1/users/me/2fa/totp/disable", map[string]any{"password": "wrong"}, session).Code)
+    require.Equal(t, http.StatusNoContent, post("/api/v1/users/me/2fa/totp/disable", map[string]any{"password": reg["password"]}, session).Code)
+    require.NotNil(t, responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid"))
+}
+
+func TestAPI_TOTPLoginCountsTowardLockout(t *testing.T) {
+    s, _ := newTestServer(t)
+    s.Auth.LoginDelayAfter = 100
+    s.Auth.LoginLockThreshold = 3
+    reg := registerUser(t, s, "tfl")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    post := func(path string, payload map[string]any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    w := post("/api/v1/users/me/2fa/totp", map[string]any{}, session)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var enroll struct{ Secret string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &enroll))
+    code, err := totp.Code(enroll.Secret, time.Now())
+    require.NoError(t, err)
+    require.Equal(t, http.StatusOK, post("/api/v1/users/me/2fa/totp/confirm", map[string]any{"code": code}, session).Code)
+    next, err := totp.Code(enroll.Secret, time.Now().Add(totp.Period*time.Second))
+    require.NoError(t, err)
+
+    login := func() *httptest.ResponseRecorder {
+        return doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+    }
+    challenge := func() string {
+        w := login()
+        require.Equal(t, http.StatusOK, w.Code)
+        var resp struct{ ChallengeToken string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        require.NotEmpty(t, resp.ChallengeToken)
+        return resp.ChallengeToken
+    }
+
+    // the right password alone does not reset the failure count
+    held := challenge()
+    for i := 0; i < 3; i++ {
+        require.Equal(t, http.StatusUnauthorized, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": challenge(), "code": "000000"}, nil).Code)
+    }
+    require.Equal(t, http.StatusLocked, post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": held, "code": next}, nil).Code)
+    require.Equal(t, http.StatusLocked, login().Code)
+
+    // open challenges per user are capped, so new logins cannot add tries
+    require.NoError(t, s.DB.Exec("DELETE FROM login_attempts WHERE identifier = ?", reg["username"]).Error)
+    for i := 4; i < loginChallengeLimit; i++ {
+        challenge()
+    }
+    require.Equal(t, http.StatusTooManyRequests, login().Code)
+
+    // a challenge cannot outlive the account it was issued for
+    require.NoError(t, s.DB.Exec("UPDATE users SET status = 'suspended' WHERE username = ?", reg["username"]).Error)
+    w = post("/api/v1/auth/login/2fa", map[string]any{"challengeToken": held, "code": next}, nil)
+    require.Equal(t, http.StatusUnauthorized, w.Code)
+    require.Nil(t, responseCookie(w, "sid"))
+}
+
+func TestAPI_BearerAPITokens(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "pat")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    call := func(method, path string, payload any, cookie *http.Cookie, bearer string) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        if bearer != "" {
+            req.Header.Set("Authorization", "Bearer "+bearer)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    create := func(scopes ...string) (string, string) {
+        w := call(http.MethodPost, "/api/v1/api-tokens", map[string]any{"name": "script", "scopes": scopes, "expiresInDays": 30}, session, "")
+        require.Equal(t, http.StatusCreated, w.Code)
+        var resp struct{ ID string; Token string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return resp.ID, resp.Token
+    }
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/api-tokens", map[string]any{"name": "x", "scopes": []string{"admin"}}, session, "").Code)
+
+    _, searchToken := create("search")
+    bookingID, bookingToken := create("booking")
+
+    require.Equal(t, http.StatusOK, call(http.MethodGet, "/api/v1/session/me", nil, nil, searchToken).Code)
+    require.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/v1/preorders", map[string]any{}, nil, searchToken).Code)
+    // booking tokens get past auth; the empty request then fails validation
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/preorders", map[string]any{}, nil, bookingToken).Code)
+    // tokens cannot mint tokens or manage sessions
+    require.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/v1/api-tokens", map[string]any{"name": "x", "scopes": []string{"search"}}, nil, bookingToken).Code)
+    require.Equal(t, http.StatusForbidden, call(http.MethodGet, "/api/v1/sessions", nil, nil, bookingToken).Code)
+    // an invalid bearer is not rescued by the cookie
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/api/v1/session/me", nil, session, "pat_nope").Code)
+    // other schemes do not hide the cookie
+    wb := httptest.NewRecorder()
+    rb := httptest.NewRequest(http.MethodGet, "/api/v1/session/me", nil)
+    rb.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+    rb.AddCookie(session)
+    s.R.ServeHTTP(wb, rb)
+    require.Equal(t, http.StatusOK, wb.Code)
+
+    // public lookups stay open but check the scope of a presented token
+    require.Equal(t, http.StatusOK, call(http.MethodGet, "/api/v1/stations", nil, nil, "").Code)
+    require.Equal(t, http.StatusOK, call(http.MethodGet, "/api/v1/stations", nil, nil, searchToken).Code)
+    require.Equal(t, http.StatusForbidden, call(http.MethodGet, "/api/v1/stations", nil, nil, bookingToken).Code)
+    require.Equal(t, http.StatusForbidden, call(http.MethodGet, "/api/v1/trains/search", nil, nil, bookingToken).Code)
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/api/v1/stations", nil, nil, "pat_nope").Code)
+
+    w := call(http.MethodGet, "/api/v1/api-tokens", nil, session, "")
+    require.Equal(t, http.StatusOK, w.Code)
+    require.NotContains(t, w.Body.String(), bookingToken)
+
+    require.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/api/v1/api-tokens/"+bookingID, nil, session, "").Code)
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodPost, "/api/v1/preorders", map[string]any{}, nil, bookingToken).Code)
+}
+
+func TestRateLimit_IgnoresSpoofedForwardedFor(t *testing.T) {
+    s := New(nil)
+    s.R.GET("/limited", s.RateLimit(newRateLimiter(2, time.Minute)), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+    hit := func(forwarded string) int {
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodGet, "/limited", nil)
+        req.RemoteAddr = "198.51.100.7:4000"
+        req.Header.Set("X-Forwarded-For", forwarded)
+        s.R.ServeHTTP(w, req)
+        return w.Code
+    }
+    require.Equal(t, http.StatusNoContent, hit("203.0.113.1"))
+    require.Equal(t, http.StatusNoContent, hit("203.0.113.2"))
+    require.Equal(t, http.StatusTooManyRequests, hit("203.0.113.3"))
+
+    // behind a configured proxy the forwarded client is the key
+    s.R.SetTrustedProxies([]string{"198.51.100.0/24"})
+    require.Equal(t, http.StatusNoContent, hit("203.0.113.4"))
+}
+
+func TestValidateRegister(t *testing.T) {
+    now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+    good := registerRequest{
+        Nationality: "cn", Name: "Li Lei", PassportNumber: "e12345678",
+        PassportExpirationDate: "2030-01-01", DateOfBirth: "1990-05-20", Gender: "male",
+        Username: "lilei_90", Password: "Passw0rd!", Email: "lilei@example.com", AgreeTerms: true,
+    }
+    v, errs := validateRegister(good, now)
+    require.Empty(t, errs)
+    require.Equal(t, "CN", v.Nationality)
+    require.Equal(t, "E12345678", v.PassportNumber)
+
+    // passport numbers follow the format of the issuing country
+    good.PassportNumber = "P1234567"
+    _, errs = validateRegister(good, now)
+    require.Contains(t, errs, "passportNumber")
+    good.Nationality = "NZ"
+    _, errs = validateRegister(good, now)
+    require.Empty(t, errs)
+
+    bad := registerRequest{
+        Nationality: "XX", PassportNumber: "#1",
+        PassportExpirationDate: "2025-05-31", DateOfBirth: "1990-13-01", Gender: "other",
+        Username: "9lives", Password: "password", Email: "not-an-email",
+    }
+    _, errs = validateRegister(bad, now)
+    for _, field := range []string{"nationality", "name", "passportNumber", "passportExpirationDate", "dateOfBirth", "gender", "username", "password", "email", "agreeTerms"} {
+        require.Contains(t, errs, field)
+    }
+    require.Equal(t, "passport has expired", errs["passportExpirationDate"])
+}
+
+func TestParseTravelDate(t *testing.T) {
+    now := time.Date(2025, 6, 1, 23, 30, 0, 0, time.Local)
+    for date, ok := range map[string]bool{
+        "2025-06-01": true, "2025-06-14": true, "2025-05-31": false, "2025-06-15": false,
+        "2025-13-01": false, "tomorrow": false, "2025/06/02": false, "": false,
+    } {
+        _, msg := parseTravelDate(date, now)
+        require.Equal(t, ok, msg == "", date)
+    }
+}
+
+func TestAPI_Register_FieldLevelErrors(t *testing.T) {
+    s, _ := newTestServer(t)
+    body, _ := json.Marshal(map[string]any{
+        "nationality": "ZZ", "name": "Test User", "passportNumber": "E12345678",
+        "passportExpirationDate": time.Now().AddDate(-1,0,0).Format("2006-01-02"),
+        "dateOfBirth": "yesterday", "gender": "unknown",
+        "username": "valid_user_name", "password": "short", "email": "x@example.com", "agreeTerms": true,
+    })
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register", bytes.NewReader(body))
+    req.Header.Set("Content-Type", "application/json")
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    var resp struct{ Code string; Details map[string]string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+    require.Equal(t, "invalid_parameters", resp.Code)
+    require.Len(t, resp.Details, 5)
+    for _, field := range []string{"nationality", "passportExpirationDate", "dateOfBirth", "gender", "password"} {
+        require.Contains(t, resp.Details, field)
+    }
+}
+
+func TestAPI_Register_ConflictFieldsAndAvailability(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "dup")
+    post := func(payload map[string]any) (int, map[string]string) {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        s.R.ServeHTTP(w, req)
+        var resp struct{ Details map[string]string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return w.Code, resp.Details
+    }
+    clone := func(overrides map[string]any) map[string]any {
+        out := map[string]any{}
+        for k, v := range reg {
+            out[k] = v
+        }
+        for k, v := range overrides {
+            out[k] = v
+        }
+        return out
+    }
+    code, details := post(clone(map[string]any{"email": "other_" + reg["email"].(string)}))
+    require.Equal(t, http.StatusConflict, code)
+    require.Contains(t, details, "username")
+    code, details = post(clone(map[string]any{"username": "other_" + reg["username"].(string)}))
+    require.Equal(t, http.StatusConflict, code)
+    require.Contains(t, details, "email")
+
+    remote := "10.11." + strconv.Itoa(time.Now().Nanosecond()%250) + "." + strconv.Itoa(time.Now().Second()+1) + ":5000"
+    check := func(query string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/availability?"+query, nil)
+        req.RemoteAddr = remote
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    w := check("username=" + reg["username"].(string) + "&email=free_" + reg["email"].(string))
+    require.Equal(t, http.StatusOK, w.Code)
+    var resp struct{ Username struct{ Available bool }; Email struct{ Available bool } }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+    require.False(t, resp.Username.Available)
+    require.True(t, resp.Email.Available)
+
+    for i := 1; i < availabilityPerMinute; i++ {
+        require.Equal(t, http.StatusOK, check("username=someone_else").Code)
+    }
+    require.Equal(t, http.StatusTooManyRequests, check("username=someone_else").Code)
+}
+
+func TestAPI_LoginHistory(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "hist")
+    require.Equal(t, http.StatusUnauthorized, doLogin(s, map[string]any{"identifier": reg["username"], "password": "Wr0ngPassword"}).Code)
+    first := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, first)
+    second := responseCookie(doLogin(s, map[string]any{"identifier": reg["email"], "password": reg["password"]}), "sid")
+    require.NotNil(t, second)
+
+    var lastLogin *time.Time
+    require.NoError(t, s.DB.Raw("SELECT last_login_at FROM users WHERE username = ?", reg["username"]).Scan(&lastLogin).Error)
+    require.NotNil(t, lastLogin)
+    require.WithinDuration(t, time.Now(), *lastLogin, time.Minute)
+
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/logout", nil)
+    req.AddCookie(first)
+    withCSRF(t, s, req)
+    s.R.ServeHTTP(w, req)
+    require.Equal(t, http.StatusNoContent, w.Code)
+
+    w2 := httptest.NewRecorder()
+    req2 := httptest.NewRequest(http.MethodGet, "/api/v1/users/me/login-history?pageSize=10", nil)
+    req2.AddCookie(second)
+    s.R.ServeHTTP(w2, req2)
+    require.Equal(t, http.StatusOK, w2.Code)
+    var resp struct {
+        Items []struct{ Event string; Outcome string; Reason *string; IP *string }
+        Page  struct{ Total int }
+    }
+    require.NoError(t, json.Unmarshal(w2.Body.Bytes(), &resp))
+    require.Equal(t, 4, resp.Page.Total)
+    require.Equal(t, "logout", resp.Items[0].Event)
+    require.Equal(t, "success", resp.Items[1].Outcome)
+    require.Equal(t, "failure", resp.Items[3].Outcome)
+    require.Equal(t, "invalid_password", *resp.Items[3].Reason)
+    require.NotNil(t, resp.Items[3].IP)
+}
+
+func TestAPI_Login_RehashesOutdatedPassword(t *testing.T) {
+    s, _ := newTestServer(t)
+    s.Passwords = password.New(config.PasswordConfig{Algorithm: password.Bcrypt, BcryptCost: 4})
+    reg := registerUser(t, s, "rehash")
+    hashOf := func() string {
+        var h string
+        require.NoError(t, s.DB.Raw("SELECT password_hash FROM users WHERE username = ?", reg["username"]).Scan(&h).Error)
+        return h
+    }
+    require.True(t, strings.HasPrefix(hashOf(), "$2a$04$"))
+
+    s.Passwords = password.New(config.PasswordConfig{Algorithm: password.Argon2id, Argon2Memory: 8 * 1024, Argon2Time: 1, Argon2Threads: 1})
+    require.Equal(t, http.StatusUnauthorized, doLogin(s, map[string]any{"identifier": reg["username"], "password": "Wr0ngPassword"}).Code)
+    require.True(t, strings.HasPrefix(hashOf(), "$2a$04$"))
+
+    require.Equal(t, http.StatusOK, doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}).Code)
+    require.True(t, strings.HasPrefix(hashOf(), "$argon2id$v=19$m=8192,t=1,p=1$"))
+    require.Equal(t, http.StatusOK, doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}).Code)
+}
+
+func TestAPI_CSRFAndCookieAttributes(t *testing.T) {
+    s, _ := newTestServer(t)
+    s.Auth.CookieSecure = true
+    reg := registerUser(t, s, "csrf")
+    w := doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]})
+    require.Equal(t, http.StatusOK, w.Code)
+    session := responseCookie(w, "sid")
+    require.NotNil(t, session)
+    require.True(t, session.HttpOnly)
+    require.True(t, session.Secure)
+    require.Equal(t, http.SameSiteLaxMode, session.SameSite)
+    var login struct{ Session struct{ CSRFToken string } }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+    require.NotEmpty(t, login.Session.CSRFToken)
+
+    logout := func(token string) *httptest.ResponseRecorder {
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/logout", nil)
+        req.AddCookie(session)
+        if token != "" {
+            req.Header.Set(csrfHeader, token)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    // a cross-site form post carries the cookie but cannot know the token
+    for _, token := range []string{"", "forged"} {
+        w := logout(token)
+        require.Equal(t, http.StatusForbidden, w.Code)
+        require.Contains(t, w.Body.String(), "csrf_failed")
+    }
+
+    w2 := httptest.NewRecorder()
+    req2 := httptest.NewRequest(http.MethodGet, "/api/v1/auth/csrf", nil)
+    req2.AddCookie(session)
+    s.R.ServeHTTP(w2, req2)
+    require.Equal(t, http.StatusOK, w2.Code)
+    require.Contains(t, w2.Body.String(), login.Session.CSRFToken)
+
+    require.Equal(t, http.StatusNoContent, logout(login.Session.CSRFToken).Code)
+}
+
+func TestAPI_Profile(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "prof")
+    login := func(password string) *http.Cookie {
+        return responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": password}), "sid")
+    }
+    session, other := login(reg["password"].(string)), login(reg["password"].(string))
+    require.NotNil(t, session)
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    type profileResp struct{ User struct{ Name string; Nationality string; PassportNumber string; DateOfBirth string; Gender string; Email string } }
+    read := func(w *httptest.ResponseRecorder) profileResp {
+        var resp profileResp
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return resp
+    }
+
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/api/v1/users/me", nil, nil).Code)
+    w := call(http.MethodGet, "/api/v1/users/me", nil, session)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, "Test User", read(w).User.Name)
+    require.Equal(t, reg["dateOfBirth"], read(w).User.DateOfBirth)
+
+    // partial update with registration rules
+    w = call(http.MethodPatch, "/api/v1/users/me", map[string]any{"nationality": "XX", "gender": "other"}, session)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "nationality")
+    require.NotContains(t, w.Body.String(), "passportNumber")
+    // a new nationality must fit the stored passport number
+    w = call(http.MethodPatch, "/api/v1/users/me", map[string]any{"nationality": "jp"}, session)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "passportNumber")
+    w = call(http.MethodPatch, "/api/v1/users/me", map[string]any{"name": "  New Name ", "nationality": "jp", "passportNumber": "tk 1234567", "gender": "female"}, session)
+    require.Equal(t, http.StatusOK, w.Code)
+    p := read(w).User
+    require.Equal(t, "New Name", p.Name)
+    require.Equal(t, "JP", p.Nationality)
+    require.Equal(t, "female", p.Gender)
+    require.Equal(t, "TK1234567", p.PassportNumber)
+
+    // password change keeps this session and ends the others
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodPost, "/api/v1/users/me/password", map[string]any{"currentPassword": "Wr0ngPassword", "newPassword": "N3wPassw0rd"}, session).Code)
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/users/me/password", map[string]any{"currentPassword": reg["password"], "newPassword": "short"}, session).Code)
+    require.Equal(t, http.StatusNoContent, call(http.MethodPost, "/api/v1/users/me/password", map[string]any{"currentPassword": reg["password"], "newPassword": "N3wPassw0rd"}, session).Code)
+    require.Equal(t, http.StatusOK, call(http.MethodGet, "/api/v1/users/me", nil, session).Code)
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodGet, "/api/v1/users/me", nil, other).Code)
+    require.NotNil(t, login("N3wPassw0rd"))
+
+    // email change waits for confirmation from the new address
+    newEmail := "new_" + reg["email"].(string)
+    require.Equal(t, http.StatusConflict, call(http.MethodPost, "/api/v1/users/me/email", map[string]any{"email": reg["email"], "password": "N3wPassw0rd"}, session).Code)
+    require.Equal(t, http.StatusAccepted, call(http.MethodPost, "/api/v1/users/me/email", map[string]any{"email": newEmail, "password": "N3wPassw0rd"}, session).Code)
+    // further change mails are throttled like the other token mails
+    w = call(http.MethodPost, "/api/v1/users/me/email", map[string]any{"email": "other_" + reg["email"].(string), "password": "N3wPassw0rd"}, session)
+    require.Equal(t, http.StatusTooManyRequests, w.Code)
+    require.NotEmpty(t, w.Header().Get("Retry-After"))
+    require.Equal(t, reg["email"], read(call(http.MethodGet, "/api/v1/users/me", nil, session)).User.Email)
+    token := lastMailToken(t, s, newEmail)
+    require.Equal(t, http.StatusNoContent, call(http.MethodPost, "/api/v1/auth/email/confirm", map[string]any{"token": token}, nil).Code)
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/auth/email/confirm", map[string]any{"token": token}, nil).Code)
+    require.Equal(t, newEmail, read(call(http.MethodGet, "/api/v1/users/me", nil, session)).User.Email)
+}
+
+func TestAPI_AccountExportAndDeletion(t *testing.T) {
+    s, r := newTestServer(t)
+    reg := registerUser(t, s, "bye")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    other := responseCookie(doLogin(s, map[string]any{"identifier": reg["email"], "password": reg["password"]}), "sid")
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(cookie)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+
+    w := call(http.MethodGet, "/api/v1/users/me/export", nil, session)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+    var export struct {
+        Profile      struct{ Username string; Email string }
+        Sessions     []map[string]any
+        LoginHistory []map[string]any
+        Preorders    []map[string]any
+    }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+    require.Equal(t, reg["username"], export.Profile.Username)
+    require.Len(t, export.Sessions, 2)
+    require.Len(t, export.LoginHistory, 2)
+    require.NotNil(t, export.Preorders)
+
+    var uid string
+    require.NoError(t, s.DB.Raw("SELECT id FROM users WHERE username = ?", reg["username"]).Scan(&uid).Error)
+
+    require.Equal(t, http.StatusUnauthorized, call(http.MethodDelete, "/api/v1/users/me", map[string]any{"password": "Wr0ngPassword"}, session).Code)
+    w = call(http.MethodDelete, "/api/v1/users/me", map[string]any{"password": reg["password"]}, session)
+    require.Equal(t, http.StatusNoContent, w.Code)
+
+    var row struct{ Username string; Email *string; Name *string; PassportNumber *string; Status string; DeletedAt *time.Time }
+    require.NoError(t, s.DB.Raw("SELECT username, email, name, passport_number, status, deleted_at FROM users WHERE id = ?", uid).Scan(&row).Error)
+    require.NotEqual(t, reg["username"], row.Username)
+    require.Nil(t, row.Email)
+    require.Nil(t, row.Name)
+    require.Nil(t, row.PassportNumber)
+    require.Equal(t, "deleted", row.Status)
+    require.NotNil(t, row.DeletedAt)
+
+    // the login audit trail is kept but no longer names the account or
+    // where it was used from
+    var audit struct{ Events int; NamedEvents int; Attempts int; NamedAttempts int }
+    require.NoError(t, s.DB.Raw(`SELECT (SELECT count(*) FROM login_events WHERE user_id = ?) AS events,
+                                        (SELECT count(*) FROM login_events WHERE user_id = ?
+                                            AND (identifier IS NOT NULL OR ip IS NOT NULL OR user_agent IS NOT NULL)) AS named_events,
+                                        (SELECT count(*) FROM login_attempts WHERE user_id = ?) AS attempts,
+                                        (SELECT count(*) FROM login_attempts WHERE user_id = ? AND (identifier IN (?, ?) OR ip IS NOT NULL)) AS named_attempts`,
+        uid, uid, uid, uid, reg["username"], reg["email"]).Scan(&audit).Error)
+    require.Positive(t, audit.Events)
+    require.Zero(t, audit.NamedEvents)
+    require.Positive(t, audit.Attempts)
+    require.Zero(t, audit.NamedAttempts)
+
+    for _, ck := range []*http.Cookie{session, other} {
+        sessUser, err := r.SessionUser(ck.Value)
+        require.NoError(t, err)
+        require.Empty(t, sessUser)
+    }
+    require.Equal(t, http.StatusUnauthorized, doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}).Code)
+    // the email can be registered again
+    wa := httptest.NewRecorder()
+    s.R.ServeHTTP(wa, httptest.NewRequest(http.MethodGet, "/api/v1/auth/availability?email="+reg["email"].(string), nil))
+    require.Equal(t, http.StatusOK, wa.Code)
+    require.Contains(t, wa.Body.String(), `"email":{"available":true}`)
+}
+
+func TestAPI_AdminRoutesRequireAdminRole(t *testing.T) {
+    s, r := newTestServer(t)
+    s.SeedDir = filepath.Join("..", "..", "..", "init-scripts")
+    admin := adminSession(t, s)
+    reg := registerUser(t, s, "cust")
+    customer := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if cookie != nil {
+            req.AddCookie(cookie)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+
+    // the old unauthenticated job endpoint is gone
+    require.Equal(t, http.StatusNotFound, call(http.MethodPost, "/internal/jobs/rolling14", nil, nil).Code)
+    for _, path := range []string{"/api/v1/admin/jobs/rolling14", "/api/v1/admin/init-seed"} {
+        require.Equal(t, http.StatusUnauthorized, call(http.MethodPost, path, nil, nil).Code)
+        require.Equal(t, http.StatusForbidden, call(http.MethodPost, path, nil, customer).Code)
+    }
+    require.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil, admin).Code)
+
+    // seeding is idempotent
+    w := call(http.MethodPost, "/api/v1/admin/init-seed", nil, admin)
+    require.Equal(t, http.StatusCreated, w.Code)
+    w = call(http.MethodPost, "/api/v1/admin/init-seed", nil, admin)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var seed struct{ Inserted map[string]int64; Scripts []string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &seed))
+    require.Equal(t, int64(0), seed.Inserted["stations"])
+    require.Equal(t, int64(0), seed.Inserted["segment_seat_inventory"])
+    require.Contains(t, seed.Scripts, "01-seed-data.sql")
+    require.NotContains(t, seed.Scripts, "00-init.sql")
+
+    // admins can promote others; the repo grants roles for the CLI
+    var uid string
+    require.NoError(t, s.DB.Raw("SELECT id FROM users WHERE username = ?", reg["username"]).Scan(&uid).Error)
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPut, "/api/v1/admin/users/"+uid+"/role", map[string]any{"role": "root"}, admin).Code)
+    require.Equal(t, http.StatusOK, call(http.MethodPut, "/api/v1/admin/users/"+uid+"/role", map[string]any{"role": "support"}, admin).Code)
+    require.Equal(t, http.StatusForbidden, call(http.MethodPost, "/api/v1/admin/init-seed", nil, customer).Code)
+    n, err := r.SetUserRole(reg["email"].(string), "admin")
+    require.NoError(t, err)
+    require.Equal(t, int64(1), n)
+    require.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil, customer).Code)
+}
+
+func TestAPI_OIDCLogin(t *testing.T) {
+    s, _ := newTestServer(t)
+    iss, err := oidctest.NewIssuer("web-client", "s3cret")
+    require.NoError(t, err)
+    defer iss.Close()
+    s.OIDC = oidc.New(oidc.Config{Issuer: iss.URL, ClientID: "web-client", ClientSecret: "s3cret", RedirectURL: "http://localhost:5173/oidc/callback"})
+    reg := registerUser(t, s, "sso")
+    subject := "sub-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+    // signIn runs the browser side of the flow and returns the callback
+    // response; session, if set, is the browser's local sign-in
+    signIn := func(user oidctest.User, keepCookie bool, session *http.Cookie) *httptest.ResponseRecorder {
+        iss.SignInAs(user)
+        w := httptest.NewRecorder()
+        s.R.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/auth/oidc/start", nil))
+        require.Equal(t, http.StatusOK, w.Code)
+        var start struct{ AuthorizationUrl string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &start))
+        stateCookie := responseCookie(w, "oidc_state")
+        require.NotNil(t, stateCookie)
+
+        client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+        resp, err := client.Get(start.AuthorizationUrl)
+        require.NoError(t, err)
+        resp.Body.Close()
+        loc, err := url.Parse(resp.Header.Get("Location"))
+        require.NoError(t, err)
+        body, _ := json.Marshal(map[string]any{"code": loc.Query().Get("code"), "state": loc.Query().Get("state")})
+        w2 := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/oidc/callback", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if keepCookie {
+            req.AddCookie(stateCookie)
+        }
+        if session != nil {
+            req.AddCookie(session)
+            withCSRF(t, s, req)
+        }
+        s.R.ServeHTTP(w2, req)
+        return w2
+    }
+
+    // a verified email alone does not link unless the provider is trusted for it
+    w := signIn(oidctest.User{Subject: subject, Email: reg["email"].(string), EmailVerified: true}, true, nil)
+    require.Equal(t, http.StatusForbidden, w.Code)
+    require.Contains(t, w.Body.String(), "account_not_linked")
+
+    // signing in locally first links the subject to that account
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    // the state must come back from the same browser
+    require.Equal(t, http.StatusBadRequest, signIn(oidctest.User{Subject: subject}, false, session).Code)
+    w = signIn(oidctest.User{Subject: subject}, true, session)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.NotNil(t, responseCookie(w, "sid"))
+    var linked int
+    require.NoError(t, s.DB.Raw("SELECT count(*) FROM user_identities WHERE issuer = ? AND subject = ?", iss.URL, subject).Scan(&linked).Error)
+    require.Equal(t, 1, linked)
+
+    // once linked, the subject signs in even after the provider-side email changes
+    w = signIn(oidctest.User{Subject: subject, Email: "changed@example.org", EmailVerified: false}, true, nil)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Contains(t, w.Body.String(), reg["username"].(string))
+
+    // with LinkByEmail, a verified email links; an unverified one never does
+    s.OIDC = oidc.New(oidc.Config{Issuer: iss.URL, ClientID: "web-client", ClientSecret: "s3cret", RedirectURL: "http://localhost:5173/oidc/callback", LinkByEmail: true})
+    other := registerUser(t, s, "ssomail")
+    subject2 := subject + "-2"
+    require.Equal(t, http.StatusForbidden, signIn(oidctest.User{Subject: subject2, Email: other["email"].(string)}, true, nil).Code)
+    w = signIn(oidctest.User{Subject: subject2, Email: other["email"].(string), EmailVerified: true}, true, nil)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Contains(t, w.Body.String(), other["username"].(string))
+}
+
+func TestAPI_Passengers(t *testing.T) {
+    s, _ := newTestServer(t)
+    reg := registerUser(t, s, "pax")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    call := func(method, path string, payload any) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(session)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    type passenger struct {
+        ID                  string
+        Name                string
+        DocumentType        string
+        DocumentNumber      string
+        TicketType          string
+        EligibleTicketTypes []string
+        VerificationStatus  string
+        IsSelf              bool
+    }
+    list := func() []passenger {
+        w := call(http.MethodGet, "/api/v1/passengers", nil)
+        require.Equal(t, http.StatusOK, w.Code)
+        var resp struct{ Items []passenger }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return resp.Items
+    }
+    adult := func(number string) map[string]any {
+        return map[string]any{"name": "Li Lei", "documentType": "passport", "documentNumber": number, "nationality": "CN",
+            "dateOfBirth": time.Now().AddDate(-40, 0, 0).Format("2006-01-02"), "documentExpirationDate": time.Now().AddDate(5, 0, 0).Format("2006-01-02")}
+    }
+
+    // the account holder is there from registration
+    items := list()
+    require.Len(t, items, 1)
+    require.True(t, items[0].IsSelf)
+    require.Equal(t, "Test User", items[0].Name)
+    require.Equal(t, "E12345678", items[0].DocumentNumber)
+    require.Equal(t, http.StatusBadRequest, call(http.MethodDelete, "/api/v1/passengers/"+items[0].ID, nil).Code)
+
+    // ticket types follow the age rules
+    child := map[string]any{"name": "Li Xiaoming", "documentType": "passport", "documentNumber": "E00000001", "nationality": "CN",
+        "dateOfBirth": time.Now().AddDate(-4, 0, 0).Format("2006-01-02"), "ticketType": "student",
+        "documentExpirationDate": time.Now().AddDate(5, 0, 0).Format("2006-01-02")}
+    w := call(http.MethodPost, "/api/v1/passengers", child)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "ticketType")
+    child["ticketType"] = "child"
+    w = call(http.MethodPost, "/api/v1/passengers", child)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var created passenger
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+    require.Equal(t, []string{"adult", "child"}, created.EligibleTicketTypes)
+    require.Equal(t, "pending", created.VerificationStatus)
+
+    w = call(http.MethodPost, "/api/v1/passengers", map[string]any{"name": "", "documentType": "visa", "documentNumber": "1"})
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    for _, field := range []string{"name", "documentType", "dateOfBirth"} {
+        require.Contains(t, w.Body.String(), field)
+    }
+    require.Equal(t, http.StatusConflict, call(http.MethodPost, "/api/v1/passengers", child).Code)
+
+    // patches are validated against the merged record
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPatch, "/api/v1/passengers/"+created.ID, map[string]any{"dateOfBirth": time.Now().AddDate(-20, 0, 0).Format("2006-01-02")}).Code)
+    w = call(http.MethodPatch, "/api/v1/passengers/"+created.ID, map[string]any{"name": "Li Ming", "dateOfBirth": time.Now().AddDate(-20, 0, 0).Format("2006-01-02"), "ticketType": "student"})
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Contains(t, w.Body.String(), `"name":"Li Ming"`)
+    require.Equal(t, http.StatusNotFound, call(http.MethodPatch, "/api/v1/passengers/00000000-0000-0000-0000-000000000000", map[string]any{"name": "x"}).Code)
+    require.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/api/v1/passengers/"+created.ID, nil).Code)
+    require.Equal(t, http.StatusNotFound, call(http.MethodDelete, "/api/v1/passengers/"+created.ID, nil).Code)
+
+    // a resident ID fills in the birth date and gender and must agree with them
+    resident := map[string]any{"name": "Wang Fang", "documentType": "resident_id", "documentNumber": "11010519491231002x"}
+    w = call(http.MethodPost, "/api/v1/passengers", map[string]any{"name": "Wang Fang", "documentType": "resident_id", "documentNumber": "110105194912310021"})
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "check digit")
+    w = call(http.MethodPost, "/api/v1/passengers", map[string]any{"name": "Wang Fang", "documentType": "resident_id", "documentNumber": "11010519491231002X",
+        "dateOfBirth": "1950-01-01", "gender": "male", "nationality": "JP"})
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    for _, field := range []string{"dateOfBirth", "gender", "nationality"} {
+        require.Contains(t, w.Body.String(), field)
+    }
+    w = call(http.MethodPost, "/api/v1/passengers", resident)
+    require.Equal(t, http.StatusCreated, w.Code)
+    require.Contains(t, w.Body.String(), `"dateOfBirth":"1949-12-31"`)
+    require.Contains(t, w.Body.String(), `"gender":"female"`)
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+    require.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/api/v1/passengers/"+created.ID, nil).Code)
+
+    // expired documents and mismatched permits are refused
+    expired := adult("E00000002")
+    expired["documentExpirationDate"] = time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+    w = call(http.MethodPost, "/api/v1/passengers", expired)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "documentExpirationDate")
+    permit := adult("H12345678")
+    permit["documentType"] = "hk_macau_permit"
+    w = call(http.MethodPost, "/api/v1/passengers", permit)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "nationality")
+
+    // a passenger whose document ran out can still be edited and renewed
+    w = call(http.MethodPost, "/api/v1/passengers", adult("E00000003"))
+    require.Equal(t, http.StatusCreated, w.Code)
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+    require.NoError(t, s.DB.Exec("UPDATE passengers SET document_expiration_date = current_date - 1 WHERE id = ?", created.ID).Error)
+    require.Equal(t, http.StatusOK, call(http.MethodPatch, "/api/v1/passengers/"+created.ID, map[string]any{"name": "Li Lei Jr"}).Code)
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPatch, "/api/v1/passengers/"+created.ID, map[string]any{"documentNumber": "E00000004"}).Code)
+    w = call(http.MethodPatch, "/api/v1/passengers/"+created.ID, map[string]any{"documentExpirationDate": time.Now().AddDate(10, 0, 0).Format("2006-01-02")})
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/api/v1/passengers/"+created.ID, nil).Code)
+
+    // profile changes reach the account holder's passenger
+    require.Equal(t, http.StatusOK, call(http.MethodPatch, "/api/v1/users/me", map[string]any{"name": "Renamed User"}).Code)
+    require.Equal(t, "Renamed User", list()[0].Name)
+
+    // concurrent adds cannot go past the limit
+    for i := 0; i < maxPassengers-2; i++ {
+        require.Equal(t, http.StatusCreated, call(http.MethodPost, "/api/v1/passengers", adult(fmt.Sprintf("G%08d", i))).Code)
+    }
+    var wg sync.WaitGroup
+    codes := make([]int, 8)
+    for i := range codes {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            codes[i] = call(http.MethodPost, "/api/v1/passengers", adult(fmt.Sprintf("D%08d", i))).Code
+        }(i)
+    }
+    wg.Wait()
+    created2 := 0
+    for _, code := range codes {
+        if code == http.StatusCreated {
+            created2++
+        } else {
+            require.Equal(t, http.StatusConflict, code)
+        }
+    }
+    require.Equal(t, 1, created2)
+    require.Len(t, list(), maxPassengers)
+    w = call(http.MethodPost, "/api/v1/passengers", adult("S00000001"))
+    require.Equal(t, http.StatusConflict, w.Code)
+    require.Contains(t, w.Body.String(), "passenger_limit")
+}
+
+func TestAPI_PreorderLifecycle(t *testing.T) {
+    s, r := newTestServer(t)
+    wj := httptest.NewRecorder()
+    rj := httptest.NewRequest(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil)
+    rj.AddCookie(adminSession(t, s))
+    withCSRF(t, s, rj)
+    s.R.ServeHTTP(wj, rj)
+    require.Equal(t, http.StatusOK, wj.Code)
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else if s.Code == "SHH" { shh = s.ID } }
+    _, segID, err := r.ServiceAndSegment("D5", time.Now(), bjp, shh)
+    require.NoError(t, err)
+
+    login := func(prefix string) *http.Cookie {
+        reg := registerUser(t, s, prefix)
+        ck := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+        require.NotNil(t, ck)
+        return ck
+    }
+    owner, stranger := login("po"), login("po2")
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(cookie)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    w := call(http.MethodPost, "/api/v1/preorders", map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+        "fromStationId": bjp, "toStationId": shh, "seatType": "second"}, owner)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var created struct{ PreorderID string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+    type item struct {
+        ID               string
+        Status           string
+        TrainNo          string
+        FromStationCode  string
+        ToStationCode    string
+        SeatType         string
+        PriceCents       int
+        TotalCents       int
+        RemainingSeconds int
+    }
+    w = call(http.MethodGet, "/api/v1/preorders/"+created.PreorderID, nil, owner)
+    require.Equal(t, http.StatusOK, w.Code)
+    var detail item
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+    require.Equal(t, "active", detail.Status)
+    require.Equal(t, "D5", detail.TrainNo)
+    require.Equal(t, "BJP", detail.FromStationCode)
+    require.Equal(t, "SHH", detail.ToStationCode)
+    require.Positive(t, detail.PriceCents)
+    require.Equal(t, detail.PriceCents, detail.TotalCents)
+    require.InDelta(t, 15*60, detail.RemainingSeconds, 5)
+
+    list := func(query string) []item {
+        w := call(http.MethodGet, "/api/v1/preorders"+query, nil, owner)
+        require.Equal(t, http.StatusOK, w.Code)
+        var resp struct{ Items []item }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+        return resp.Items
+    }
+    require.Len(t, list(""), 1)
+    require.Len(t, list("?status=active"), 1)
+    require.Empty(t, list("?status=canceled"))
+    require.Equal(t, http.StatusBadRequest, call(http.MethodGet, "/api/v1/preorders?status=paid", nil, owner).Code)
+
+    // other users cannot see or cancel it
+    require.Equal(t, http.StatusNotFound, call(http.MethodGet, "/api/v1/preorders/"+created.PreorderID, nil, stranger).Code)
+    require.Equal(t, http.StatusNotFound, call(http.MethodPost, "/api/v1/preorders/"+created.PreorderID+"/cancel", nil, stranger).Code)
+
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-1, left)
+    w = call(http.MethodPost, "/api/v1/preorders/"+created.PreorderID+"/cancel", nil, owner)
+    require.Equal(t, http.StatusOK, w.Code)
+    require.Contains(t, w.Body.String(), `"status":"canceled"`)
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore, left)
+    w = call(http.MethodPost, "/api/v1/preorders/"+created.PreorderID+"/cancel", nil, owner)
+    require.Equal(t, http.StatusConflict, w.Code)
+    require.Contains(t, w.Body.String(), "preorder_not_active")
+    require.Len(t, list("?status=canceled"), 1)
+}
+
+func TestAPI_GroupPreorderHoldsAllSeatsOrNone(t *testing.T) {
+    s, r := newTestServer(t)
+    wj := httptest.NewRecorder()
+    rj := httptest.NewRequest(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil)
+    rj.AddCookie(adminSession(t, s))
+    withCSRF(t, s, rj)
+    s.R.ServeHTTP(wj, rj)
+    require.Equal(t, http.StatusOK, wj.Code)
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else if s.Code == "SHH" { shh = s.ID } }
+    _, segID, err := r.ServiceAndSegment("D5", time.Now(), bjp, shh)
+    require.NoError(t, err)
+
+    login := func(prefix string) *http.Cookie {
+        reg := registerUser(t, s, prefix)
+        ck := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+        require.NotNil(t, ck)
+        return ck
+    }
+    owner, stranger := login("grp"), login("grp2")
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(cookie)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    addPassenger := func(cookie *http.Cookie, number string, age int) string {
+        w := call(http.MethodPost, "/api/v1/passengers", map[string]any{"name": "Traveller " + number, "documentType": "passport",
+            "documentNumber": number, "nationality": "CN", "dateOfBirth": time.Now().AddDate(-age, 0, -1).Format("2006-01-02"),
+            "documentExpirationDate": time.Now().AddDate(5, 0, 0).Format("2006-01-02"), "ticketType": "adult"}, cookie)
+        require.Equal(t, http.StatusCreated, w.Code)
+        var p struct{ ID string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+        return p.ID
+    }
+    var list struct{ Items []struct{ ID string; IsSelf bool } }
+    w := call(http.MethodGet, "/api/v1/passengers", nil, owner)
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+    self := list.Items[0].ID
+    kid, partner := addPassenger(owner, "E00000011", 4), addPassenger(owner, "E00000012", 35)
+    foreign := addPassenger(stranger, "E00000013", 35)
+
+    book := func(passengers []map[string]any) *httptest.ResponseRecorder {
+        return call(http.MethodPost, "/api/v1/preorders", map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+            "fromStationId": bjp, "toStationId": shh, "seatType": "second", "passengers": passengers}, owner)
+    }
+
+    // every passenger is checked before anything is held
+    w = book([]map[string]any{{"passengerId": self}, {"passengerId": kid, "ticketType": "student"}, {"passengerId": self}, {"passengerId": foreign}})
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    for _, field := range []string{"passengers[1].ticketType", "passengers[2].passengerId", "passengers[3].passengerId"} {
+        require.Contains(t, w.Body.String(), field)
+    }
+
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    group := []map[string]any{{"passengerId": self}, {"passengerId": kid, "ticketType": "child"}, {"passengerId": partner, "ticketType": "adult"}}
+    w = book(group)
+    require.Equal(t, http.StatusCreated, w.Code)
+    require.Contains(t, w.Body.String(), `"holdQuantity":3`)
+    var created struct{ PreorderID string }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-3, left)
+
+    w = call(http.MethodGet, "/api/v1/preorders/"+created.PreorderID, nil, owner)
+    require.Equal(t, http.StatusOK, w.Code)
+    var detail struct {
+        HoldQuantity int
+        PriceCents   int
+        TotalCents   int
+        Passengers   []struct{ PassengerID string; Name string; TicketType string; PriceCents int }
+    }
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &detail))
+    require.Equal(t, 3, detail.HoldQuantity)
+    require.Len(t, detail.Passengers, 3)
+    require.Equal(t, kid, detail.Passengers[1].PassengerID)
+    require.Equal(t, "child", detail.Passengers[1].TicketType)
+    // the child travels at half price
+    childFare := int(math.Round(float64(detail.PriceCents) * 0.5))
+    require.Equal(t, childFare, detail.Passengers[1].PriceCents)
+    require.Equal(t, detail.PriceCents, detail.Passengers[0].PriceCents)
+    require.Equal(t, 2*detail.PriceCents+childFare, detail.TotalCents)
+
+    // removing a saved passenger leaves the booking intact
+    require.Equal(t, http.StatusNoContent, call(http.MethodDelete, "/api/v1/passengers/"+partner, nil, owner).Code)
+    w = call(http.MethodGet, "/api/v1/preorders/"+created.PreorderID, nil, owner)
+    require.Contains(t, w.Body.String(), "Traveller E00000012")
+    require.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/preorders/"+created.PreorderID+"/cancel", nil, owner).Code)
+
+    // the class must be sold on the segment and the date well-formed
+    w = call(http.MethodPost, "/api/v1/preorders", map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+        "fromStationId": bjp, "toStationId": shh, "seatType": "hovercraft", "passengers": group}, owner)
+    require.Equal(t, http.StatusBadRequest, w.Code)
+    require.Contains(t, w.Body.String(), "seatType")
+    for _, date := range []string{time.Now().Format("2006/01/02"), "2026-13-01", "tomorrow", time.Now().AddDate(0, 0, -1).Format("2006-01-02"),
+        time.Now().AddDate(0, 0, bookingRangeDays).Format("2006-01-02")} {
+        w = call(http.MethodPost, "/api/v1/preorders", map[string]any{"trainNo": "D5", "date": date,
+            "fromStationId": bjp, "toStationId": shh, "seatType": "second", "passengers": group}, owner)
+        require.Equal(t, http.StatusBadRequest, w.Code, date)
+        require.Contains(t, w.Body.String(), `"date"`, date)
+    }
+
+    // a class that cannot seat everyone holds nothing
+    require.NoError(t, s.DB.Exec("UPDATE segment_seat_inventory SET left_seats = 1 WHERE segment_id = ? AND seat_type = 'second'", segID).Error)
+    t.Cleanup(func() {
+        s.DB.Exec("UPDATE segment_seat_inventory SET left_seats = ? WHERE segment_id = ? AND seat_type = 'second'", leftBefore, segID)
+    })
+    w = book(group[:2])
+    require.Equal(t, http.StatusConflict, w.Code)
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, 1, left)
+    var held int
+    require.NoError(t, s.DB.Raw("SELECT count(*) FROM preorder_passengers WHERE passenger_id = ?", kid).Scan(&held).Error)
+    require.Equal(t, 1, held)
+}
+
+func TestAPI_PreorderIdempotencyKey(t *testing.T) {
+    s, r := newTestServer(t)
+    wj := httptest.NewRecorder()
+    rj := httptest.NewRequest(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil)
+    rj.AddCookie(adminSession(t, s))
+    withCSRF(t, s, rj)
+    s.R.ServeHTTP(wj, rj)
+    require.Equal(t, http.StatusOK, wj.Code)
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else if s.Code == "SHH" { shh = s.ID } }
+    _, segID, err := r.ServiceAndSegment("D5", time.Now(), bjp, shh)
+    require.NoError(t, err)
+
+    reg := registerUser(t, s, "idem")
+    session := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, session)
+    other := registerUser(t, s, "idem2")
+    otherSession := responseCookie(doLogin(s, map[string]any{"identifier": other["username"], "password": other["password"]}), "sid")
+    book := func(cookie *http.Cookie, key, seatType string) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+            "fromStationId": bjp, "toStationId": shh, "seatType": seatType})
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodPost, "/api/v1/preorders", bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        if key != "" {
+            req.Header.Set(idempotencyHeader, key)
+        }
+        req.AddCookie(cookie)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    var uid string
+    require.NoError(t, s.DB.Raw("SELECT id FROM users WHERE username = ?", reg["username"]).Scan(&uid).Error)
+    countPreorders := func() int {
+        var n int
+        require.NoError(t, s.DB.Raw("SELECT count(*) FROM preorders WHERE user_id = ?", uid).Scan(&n).Error)
+        return n
+    }
+
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    key := "retry-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+    first := book(session, key, "second")
+    require.Equal(t, http.StatusCreated, first.Code)
+    require.Empty(t, first.Header().Get(idempotencyReplayedHeader))
+
+    // a retry gets the original response and holds nothing more
+    retry := book(session, key, "second")
+    require.Equal(t, http.StatusCreated, retry.Code)
+    require.Equal(t, "true", retry.Header().Get(idempotencyReplayedHeader))
+    require.JSONEq(t, first.Body.String(), retry.Body.String())
+    require.Equal(t, 1, countPreorders())
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-1, left)
+
+    // the same key with another body is refused
+    w := book(session, key, "first")
+    require.Equal(t, http.StatusConflict, w.Code)
+    require.Contains(t, w.Body.String(), "idempotency_key_reused")
+    // keys belong to one user
+    require.Equal(t, http.StatusCreated, book(otherSession, key, "second").Code)
+    require.Equal(t, http.StatusBadRequest, book(session, strings.Repeat("k", 256), "second").Code)
+
+    // a double submit creates one preorder; the loser either replays or is told to retry
+    key = key + "-double"
+    var wg sync.WaitGroup
+    codes := make([]int, 2)
+    for i := range codes {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            codes[i] = book(session, key, "second").Code
+        }(i)
+    }
+    wg.Wait()
+    require.Contains(t, codes, http.StatusCreated)
+    for _, code := range codes {
+        require.Contains(t, []int{http.StatusCreated, http.StatusConflict}, code)
+    }
+    require.Equal(t, 2, countPreorders())
+
+    // an unfinished claim is not taken over while its lease is renewed,
+    // however long the request has been running
+    key = key + "-slow"
+    body, _ := json.Marshal(map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+        "fromStationId": bjp, "toStationId": shh, "seatType": "second"})
+    fingerprint := requestFingerprint(http.MethodPost, "/api/v1/preorders", body)
+    require.NoError(t, s.DB.Exec(`INSERT INTO idempotency_keys(user_id, key, request_hash, created_at, expires_at, lease_until)
+                                  VALUES (?, ?, ?, now() - interval '1 hour', now() + interval '1 day', now() + interval '30 seconds')`, uid, key, fingerprint).Error)
+    w = book(session, key, "second")
+    require.Equal(t, http.StatusConflict, w.Code)
+    require.Contains(t, w.Body.String(), "idempotency_in_progress")
+    require.Equal(t, 2, countPreorders())
+    // once the lease lapses the claimant is presumed dead and the key is free
+    require.NoError(t, s.DB.Exec("UPDATE idempotency_keys SET lease_until = now() - interval '1 second' WHERE user_id = ? AND key = ?", uid, key).Error)
+    require.Equal(t, http.StatusCreated, book(session, key, "second").Code)
+    require.Equal(t, 3, countPreorders())
+
+    // without a key every request is a new booking
+    require.Equal(t, http.StatusCreated, book(session, "", "second").Code)
+    require.Equal(t, 4, countPreorders())
+}
+
+func TestAPI_Orders(t *testing.T) {
+    s, r := newTestServer(t)
+    wj := httptest.NewRecorder()
+    rj := httptest.NewRequest(http.MethodPost, "/api/v1/admin/jobs/rolling14", nil)
+    rj.AddCookie(adminSession(t, s))
+    withCSRF(t, s, rj)
+    s.R.ServeHTTP(wj, rj)
+    require.Equal(t, http.StatusOK, wj.Code)
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else if s.Code == "SHH" { shh = s.ID } }
+    _, segID, err := r.ServiceAndSegment("D5", time.Now(), bjp, shh)
+    require.NoError(t, err)
+
+    reg := registerUser(t, s, "ord")
+    owner := responseCookie(doLogin(s, map[string]any{"identifier": reg["username"], "password": reg["password"]}), "sid")
+    require.NotNil(t, owner)
+    var ownerID string
+    require.NoError(t, s.DB.Raw("SELECT id FROM users WHERE username = ?", reg["username"]).Scan(&ownerID).Error)
+    reg2 := registerUser(t, s, "ord2")
+    stranger := responseCookie(doLogin(s, map[string]any{"identifier": reg2["username"], "password": reg2["password"]}), "sid")
+    require.NotNil(t, stranger)
+    call := func(method, path string, payload any, cookie *http.Cookie) *httptest.ResponseRecorder {
+        body, _ := json.Marshal(payload)
+        w := httptest.NewRecorder()
+        req := httptest.NewRequest(method, path, bytes.NewReader(body))
+        req.Header.Set("Content-Type", "application/json")
+        req.AddCookie(cookie)
+        withCSRF(t, s, req)
+        s.R.ServeHTTP(w, req)
+        return w
+    }
+    hold := func() string {
+        w := call(http.MethodPost, "/api/v1/preorders", map[string]any{"trainNo": "D5", "date": time.Now().Format("2006-01-02"),
+            "fromStationId": bjp, "toStationId": shh, "seatType": "second"}, owner)
+        require.Equal(t, http.StatusCreated, w.Code)
+        var created struct{ PreorderID string }
+        require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+        return created.PreorderID
+    }
+    leftNow := func() int {
+        left, err := r.InventoryLeft(segID, "second")
+        require.NoError(t, err)
+        return left
+    }
+
+    leftBefore := leftNow()
+    preorderID := hold()
+    require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/api/v1/orders", map[string]any{}, owner).Code)
+    require.Equal(t, http.StatusNotFound, call(http.MethodPost, "/api/v1/orders", map[string]any{"preorderId": preorderID}, stranger).Code)
+
+    w := call(http.MethodPost, "/api/v1/orders", map[string]any{"preorderId": preorderID}, owner)
+    require.Equal(t, http.StatusCreated, w.Code)
+    var order orders.Order
+    require.NoError(t, json.Unmarshal(w.Body.Bytes(), &order))
+    require.Equal(t, orders.PendingPayment, order.Status)
+    require.Equal(t, preorderID, *order.PreorderID)
+    require.Len(t, order.Items, 1)
+    require.Equal(t, "D5", order.Items[0].TrainNo)
+    require.Equal(t, order.Items[0].PriceCents, order.TotalCents)
+    // the held seat now belongs to the order
+    require.Equal(t, leftBefore-1, leftNow())
+    w = call(http.MethodGet, "/api/v1/preorders/"+preorderID, nil, owner)
+    require.Contains(t, w.Body.String(), `"status":"converted"`)
+
+    // a preorder converts once; canceling it afterwards releases nothing
+    w = call(http.MethodPost, "/api/v1/orders", map[string]any{"preorderId": preorderID}, owner)
+    require.Equal(t, http.StatusConflict, w.Code)
+    require.Contains(t, w.Body.String(), "preorder_not_active")
+    require.Equal(t, http.StatusConflict, call(http.MethodPost, "/api/v1/preorders/"+preorderID+"/cancel", nil, owner).Code)
+    require.Equal(t, leftBefore-1, leftNow())
+
+    require.Equal(t, http.StatusOK, call(http.MethodGet, "/api/v1/orders/"+order.ID, nil, owner).Code)
+    require.Equal(t, http.StatusNotFound, call(http.MethodGet, "/api/v1/orders/"+order.ID, nil, stranger).Code)
+
+    // an expired hold cannot be confirmed even before the sweeper runs
+    expired := hold()
+    require.NoError(t, s.DB.Exec("UPDATE preorders SET expires_at = now() - interval '1 second' WHERE id = ?", expired).Error)
+    require.Equal(t, http.StatusConflict, call(http.MethodPost, "/api/v1/orders", map[string]any{"preorderId": expired}, owner).Code)
+    canceled := hold()
+    require.Equal(t, http.StatusOK, call(http.MethodPost, "/api/v1/preorders/"+canceled+"/cancel", nil, owner).Code)
+    require.Equal(t, http.StatusConflict, call(http.MethodPost, "/api/v1/orders", map[string]any{"preorderId": canceled}, owner).Code)
+
+    // only legal transitions apply; a refund returns the seat
+    ctx := context.Background()
+    _, err = s.Orders.Transition(ctx, ownerID, order.ID, orders.Ticketed)
+    var terr *orders.TransitionError
+    require.ErrorAs(t, err, &terr)
+    for _, to := range []orders.Status{orders.Paid, orders.Ticketed} {
+        order, err = s.Orders.Transition(ctx, ownerID, order.ID, to)
+        require.NoError(t, err)
+        require.Equal(t, to, order.Status)
+        require.Equal(t, leftBefore-2, leftNow())
+    }
+    order, err = s.Orders.Transition(ctx, ownerID, order.ID, orders.Refunded)
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-1, leftNow())
+    _, err = s.Orders.Transition(ctx, ownerID, order.ID, orders.Changed)
+    require.ErrorAs(t, err, &terr)
+    require.Equal(t, leftBefore-1, leftNow())
+}
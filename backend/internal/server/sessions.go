@@ -0,0 +1,71 @@
+package server
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+)
+
+// Sessions are listed by a sha256 of the sid so that one device cannot read
+// another device's cookie value from the API.
+const sessionPublicID = "encode(digest(s.sid::text, 'sha256'), 'hex')"
+
+type sessionItem struct {
+    ID        string    `json:"id"`
+    CreatedAt time.Time `json:"createdAt"`
+    ExpiresAt time.Time `json:"expiresAt"`
+    UserAgent *string   `json:"userAgent"`
+    IP        *string   `json:"ip"`
+    Current   bool      `json:"current"`
+}
+
+func (s *Server) sessionRoutes(g *gin.RouterGroup) {
+    sg := g.Group("/sessions", s.RequireSession())
+    sg.GET("", s.listSessions)
+    sg.DELETE("/:id", s.revokeSession)
+    sg.POST("/revoke-others", s.revokeOtherSessions)
+}
+
+func (s *Server) listSessions(c *gin.Context) {
+    user := currentUser(c)
+    items := []sessionItem{}
+    if err := s.DB.Raw(`SELECT `+sessionPublicID+` AS id, s.created_at, s.expires_at, s.user_agent, host(s.ip) AS ip, (s.sid = ?) AS current
+                        FROM sessions s
+                        WHERE s.user_id = ? AND s.revoked_at IS NULL AND s.expires_at > now()
+                        ORDER BY s.created_at DESC`, user.SID, user.ID).Scan(&items).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not list sessions"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+func (s *Server) revokeSession(c *gin.Context) {
+    user := currentUser(c)
+    var sid string
+    s.DB.Raw(`UPDATE sessions s SET revoked_at = now()
+              WHERE s.user_id = ? AND `+sessionPublicID+` = ? AND s.revoked_at IS NULL
+              RETURNING s.sid`, user.ID, c.Param("id")).Scan(&sid)
+    if sid == "" {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"session not found"})
+        return
+    }
+    s.recordLoginEvent(c, user.ID, "", eventSessionRevoked, outcomeSuccess, "revoked_by_user")
+    if sid == user.SID {
+        s.setCookie(c, "sid", "", -1)
+    }
+    c.Status(http.StatusNoContent)
+}
+
+func (s *Server) revokeOtherSessions(c *gin.Context) {
+    user := currentUser(c)
+    res := s.DB.Exec("UPDATE sessions SET revoked_at = now() WHERE user_id = ? AND sid <> ? AND revoked_at IS NULL", user.ID, user.SID)
+    if res.Error != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not revoke sessions"})
+        return
+    }
+    if res.RowsAffected > 0 {
+        s.recordLoginEvent(c, user.ID, "", eventSessionRevoked, outcomeSuccess, "revoke_others")
+    }
+    c.JSON(http.StatusOK, gin.H{"revoked": res.RowsAffected})
+}
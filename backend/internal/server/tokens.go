@@ -0,0 +1,87 @@
+package server
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "time"
+
+    "gorm.io/gorm"
+)
+
+// Purposes of rows in user_tokens.
+const (
+    tokenPasswordReset = "password_reset"
+    tokenVerifyEmail   = "verify_email"
+    tokenChangeEmail   = "change_email"
+)
+
+// Limits on emails carrying a token, per account and purpose, so that a
+// stranger cannot flood someone's inbox.
+const (
+    tokenMailInterval = time.Minute
+    tokenMailPerHour  = 5
+)
+
+// newToken returns a random URL-safe token and the hash that is stored in
+// place of it.
+func newToken() (string, string, error) {
+    var b [32]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", "", err
+    }
+    raw := base64.RawURLEncoding.EncodeToString(b[:])
+    return raw, hashToken(raw), nil
+}
+
+func hashToken(raw string) string {
+    sum := sha256.Sum256([]byte(raw))
+    return hex.EncodeToString(sum[:])
+}
+
+// issueUserToken invalidates any outstanding token of the same purpose and
+// stores a new single-use one that expires after ttl. payload carries
+// purpose-specific data such as the new address of an email change.
+func (s *Server) issueUserToken(userID, purpose, payload string, ttl time.Duration) (string, error) {
+    raw, hash, err := newToken()
+    if err != nil {
+        return "", err
+    }
+    err = s.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Exec("UPDATE user_tokens SET used_at = now() WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).Error; err != nil {
+            return err
+        }
+        return tx.Exec("INSERT INTO user_tokens(user_id, purpose, token_hash, payload, expires_at) VALUES (?, ?, ?, ?, ?)",
+            userID, purpose, hash, nullIfEmpty(payload), time.Now().Add(ttl)).Error
+    })
+    return raw, err
+}
+
+// consumeUserToken marks a live token as used and returns its owner and
+// payload. The owner is "" when the token is unknown, expired or already used.
+func consumeUserToken(tx *gorm.DB, purpose, raw string) (string, string, error) {
+    var row struct{ UserID string; Payload *string }
+    err := tx.Raw(`UPDATE user_tokens SET used_at = now()
+                   WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > now()
+                   RETURNING user_id, payload`, hashToken(raw), purpose).Scan(&row).Error
+    if row.Payload == nil {
+        return row.UserID, "", err
+    }
+    return row.UserID, *row.Payload, err
+}
+
+// tokenMailWait reports how long to wait before another token of purpose may
+// be mailed to userID; 0 means one can be sent now.
+func (s *Server) tokenMailWait(userID, purpose string) time.Duration {
+    var sent struct{ Count int; First *time.Time; Last *time.Time }
+    s.DB.Raw(`SELECT count(*) AS count, min(created_at) AS first, max(created_at) AS last FROM user_tokens
+              WHERE user_id = ? AND purpose = ? AND created_at > now() - interval '1 hour'`, userID, purpose).Scan(&sent)
+    if sent.Last == nil {
+        return 0
+    }
+    if sent.Count >= tokenMailPerHour {
+        return time.Until(sent.First.Add(time.Hour))
+    }
+    return time.Until(sent.Last.Add(tokenMailInterval))
+}
@@ -7,7 +7,7 @@ import (
 )
 
 func (s *Server) trainsRoutes(g *gin.RouterGroup) {
-    g.GET("/trains/search", s.searchTrains)
+    g.GET("/trains/search", s.TokenScope(scopeSearch), s.searchTrains)
 }
 
 type trainsQuery struct {
@@ -0,0 +1,278 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/base32"
+    "net/http"
+    "strings"
+    "time"
+
+    "cs3604/backend/internal/totp"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+const (
+    totpIssuer          = "12306"
+    recoveryCodeCount   = 10
+    loginChallengeTTL   = 5 * time.Minute
+    loginChallengeTries = 5
+    // loginChallengeLimit unfinished challenges per user within
+    // Auth.LoginFailureWindow; more would give fresh tries at the code.
+    loginChallengeLimit = 5
+)
+
+type totpCodeRequest struct {
+    Code string `json:"code"`
+}
+
+type totpDisableRequest struct {
+    Password string `json:"password"`
+}
+
+type loginChallengeRequest struct {
+    ChallengeToken string `json:"challengeToken"`
+    Code           string `json:"code"`
+    RecoveryCode   string `json:"recoveryCode"`
+}
+
+func (s *Server) twoFactorRoutes(g *gin.RouterGroup) {
+    g.POST("/auth/login/2fa", s.loginSecondFactor)
+    tg := g.Group("/users/me/2fa/totp", s.RequireSession())
+    tg.POST("", s.enrollTOTP)
+    tg.POST("/confirm", s.confirmTOTP)
+    tg.POST("/disable", s.disableTOTP)
+}
+
+func (s *Server) totpEnabled(userID string) bool {
+    var n int
+    s.DB.Raw("SELECT count(*) FROM user_totp WHERE user_id = ? AND confirmed_at IS NOT NULL", userID).Scan(&n)
+    return n > 0
+}
+
+// newRecoveryCode returns a code like "k3v9-q2xa".
+func newRecoveryCode() (string, error) {
+    var b [5]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        return "", err
+    }
+    code := strings.ToLower(base32.StdEncoding.EncodeToString(b[:]))
+    return code[:4] + "-" + code[4:], nil
+}
+
+func normalizeRecoveryCode(v string) string {
+    return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(v), " ", ""))
+}
+
+// enrollTOTP starts (or restarts) enrollment. The secret only becomes active
+// once a code from it has been confirmed.
+func (s *Server) enrollTOTP(c *gin.Context) {
+    user := currentUser(c)
+    if s.totpEnabled(user.ID) {
+        c.JSON(http.StatusConflict, gin.H{"code":"conflict","message":"Two-factor authentication is already enabled"})
+        return
+    }
+    secret, err := totp.GenerateSecret()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not start enrollment"})
+        return
+    }
+    codes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        if codes[i], err = newRecoveryCode(); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not start enrollment"})
+            return
+        }
+    }
+    err = s.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Exec(`INSERT INTO user_totp(user_id, secret) VALUES (?, ?)
+                           ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, confirmed_at = NULL, last_step = NULL, created_at = now()`,
+            user.ID, secret).Error; err != nil {
+            return err
+        }
+        if err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID).Error; err != nil {
+            return err
+        }
+        for _, code := range codes {
+            if err := tx.Exec("INSERT INTO recovery_codes(user_id, code_hash) VALUES (?, ?)", user.ID, hashToken(code)).Error; err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not start enrollment"})
+        return
+    }
+    c.JSON(http.StatusCreated, gin.H{"secret": secret, "otpauthUri": totp.URI(totpIssuer, user.Username, secret), "recoveryCodes": codes})
+}
+
+func (s *Server) confirmTOTP(c *gin.Context) {
+    user := currentUser(c)
+    var req totpCodeRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var secret string
+    s.DB.Raw("SELECT secret FROM user_totp WHERE user_id = ? AND confirmed_at IS NULL", user.ID).Scan(&secret)
+    if secret == "" {
+        c.JSON(http.StatusNotFound, gin.H{"code":"not_found","message":"No pending enrollment"})
+        return
+    }
+    step, ok := totp.Validate(secret, req.Code, time.Now())
+    if !ok {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_code","message":"Invalid code"})
+        return
+    }
+    if err := s.DB.Exec("UPDATE user_totp SET confirmed_at = now(), last_step = ? WHERE user_id = ?", step, user.ID).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not enable two-factor authentication"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"enabled": true})
+}
+
+func (s *Server) disableTOTP(c *gin.Context) {
+    user := currentUser(c)
+    var req totpDisableRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var hash string
+    s.DB.Raw("SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&hash)
+    if !s.checkPassword(user.ID, hash, req.Password) {
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid credentials"})
+        return
+    }
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        if err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", user.ID).Error; err != nil {
+            return err
+        }
+        return tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", user.ID).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not disable two-factor authentication"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// startLoginChallenge is the first half of a 2FA login: the password was
+// right, so hand out a short-lived token to exchange for a session.
+func (s *Server) startLoginChallenge(c *gin.Context, row loginUser, identifier string, remember bool) {
+    var open struct{ Count int; First *time.Time }
+    s.DB.Raw(`SELECT count(*) AS count, min(created_at) AS first FROM login_challenges
+              WHERE user_id = ? AND consumed_at IS NULL AND created_at > ?`, row.ID, time.Now().Add(-s.Auth.LoginFailureWindow)).Scan(&open)
+    if open.Count >= loginChallengeLimit && open.First != nil {
+        t := &loginThrottle{http.StatusTooManyRequests, "rate_limited", "Too many login attempts", open.First.Add(s.Auth.LoginFailureWindow).Sub(time.Now())}
+        s.recordLoginEvent(c, row.ID, identifier, eventLogin, outcomeFailure, t.Code)
+        t.respond(c)
+        return
+    }
+    raw, hash, err := newToken()
+    if err == nil {
+        err = s.DB.Exec("INSERT INTO login_challenges(user_id, identifier, token_hash, remember_me, expires_at) VALUES (?, ?, ?, ?, ?)",
+            row.ID, identifier, hash, remember, time.Now().Add(loginChallengeTTL)).Error
+    }
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not start two-factor login"})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "challengeToken": raw, "expiresAt": time.Now().Add(loginChallengeTTL)})
+}
+
+// loginSecondFactor exchanges a challenge token plus a TOTP or recovery code
+// for a session. Wrong codes count as failed logins for the challenge's
+// identifier, so the password lockout also stops guessing the code.
+func (s *Server) loginSecondFactor(c *gin.Context) {
+    var req loginChallengeRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.ChallengeToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    ip := c.ClientIP()
+    var userID, challengeUser, identifier string
+    var remember bool
+    var throttle *loginThrottle
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        var ch struct{ ID int64; UserID string; Identifier string; RememberMe bool; Attempts int }
+        if err := tx.Raw(`SELECT lc.id, lc.user_id, COALESCE(lc.identifier, u.username) AS identifier, lc.remember_me, lc.attempts
+                          FROM login_challenges lc JOIN users u ON u.id = lc.user_id
+                          WHERE lc.token_hash = ? AND lc.consumed_at IS NULL AND lc.expires_at > now() FOR UPDATE OF lc`, hashToken(req.ChallengeToken)).Scan(&ch).Error; err != nil {
+            return err
+        }
+        if ch.ID == 0 || ch.Attempts >= loginChallengeTries {
+            return nil
+        }
+        challengeUser, identifier = ch.UserID, ch.Identifier
+        if throttle = s.checkLoginThrottle(identifier, ip); throttle != nil {
+            return nil
+        }
+        ok, err := verifySecondFactor(tx, ch.UserID, req.Code, req.RecoveryCode)
+        if err != nil {
+            return err
+        }
+        if !ok {
+            return tx.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?", ch.ID).Error
+        }
+        userID, remember = ch.UserID, ch.RememberMe
+        return tx.Exec("UPDATE login_challenges SET consumed_at = now() WHERE id = ?", ch.ID).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not verify code"})
+        return
+    }
+    if throttle != nil {
+        s.recordLoginEvent(c, challengeUser, identifier, eventLogin, outcomeFailure, throttle.Code)
+        throttle.respond(c)
+        return
+    }
+    if userID == "" {
+        if challengeUser != "" {
+            s.recordLoginAttempt(identifier, ip, challengeUser, false)
+        }
+        s.recordLoginEvent(c, challengeUser, identifier, eventLogin, outcomeFailure, "invalid_second_factor")
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid or expired code"})
+        return
+    }
+    method := "totp"
+    if req.RecoveryCode != "" {
+        method = "recovery_code"
+    }
+    // the account may have been deleted or suspended while the challenge was open
+    var row loginUser
+    if err := s.DB.Raw("SELECT id, username, email, mobile, password_hash, status FROM users WHERE id = ? AND deleted_at IS NULL", userID).Scan(&row).Error; err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not verify code"})
+        return
+    }
+    if row.ID == "" || row.Status != statusActive {
+        s.recordLoginEvent(c, userID, identifier, eventLogin, outcomeFailure, "account_unavailable")
+        c.JSON(http.StatusUnauthorized, gin.H{"code":"unauthorized","message":"Invalid or expired code"})
+        return
+    }
+    s.issueLoginSession(c, row, identifier, remember, method)
+}
+
+// verifySecondFactor checks a TOTP code (rejecting replays of an already
+// used step) or burns a recovery code.
+func verifySecondFactor(tx *gorm.DB, userID, code, recoveryCode string) (bool, error) {
+    if recoveryCode != "" {
+        res := tx.Exec("UPDATE recovery_codes SET used_at = now() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+            userID, hashToken(normalizeRecoveryCode(recoveryCode)))
+        return res.RowsAffected == 1, res.Error
+    }
+    var t struct{ Secret string; LastStep *int64 }
+    if err := tx.Raw("SELECT secret, last_step FROM user_totp WHERE user_id = ? AND confirmed_at IS NOT NULL FOR UPDATE", userID).Scan(&t).Error; err != nil {
+        return false, err
+    }
+    if t.Secret == "" {
+        return false, nil
+    }
+    step, ok := totp.Validate(t.Secret, code, time.Now())
+    if !ok || (t.LastStep != nil && step <= *t.LastStep) {
+        return false, nil
+    }
+    return true, tx.Exec("UPDATE user_totp SET last_step = ? WHERE user_id = ?", step, userID).Error
+}
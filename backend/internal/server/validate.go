@@ -0,0 +1,204 @@
+package server
+
+import (
+    "net/mail"
+    "regexp"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+
+    "cs3604/backend/internal/validation"
+)
+
+// fieldErrors maps a request field to the reason it was rejected; it is
+// returned as the details of an invalid_parameters error.
+type fieldErrors map[string]string
+
+func (e fieldErrors) add(field, reason string) {
+    if _, ok := e[field]; !ok {
+        e[field] = reason
+    }
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{5,29}$`)
+
+// iso3166Alpha2 lists the officially assigned ISO 3166-1 alpha-2 codes.
+var iso3166Alpha2 = func() map[string]bool {
+    codes := `AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+        CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+        GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP
+        KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT
+        MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+        SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG
+        UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW`
+    m := map[string]bool{}
+    for _, c := range strings.Fields(codes) {
+        m[c] = true
+    }
+    return m
+}()
+
+func validNationality(code string) bool {
+    return iso3166Alpha2[code]
+}
+
+// validatePassword enforces the UI rule: 8-64 characters with both letters
+// and digits, and not the username.
+func validatePassword(password, username string) string {
+    n := utf8.RuneCountInString(password)
+    if n < 8 || n > 64 {
+        return "must be 8-64 characters"
+    }
+    var letter, digit bool
+    for _, r := range password {
+        letter = letter || unicode.IsLetter(r)
+        digit = digit || unicode.IsDigit(r)
+    }
+    if !letter || !digit {
+        return "must contain letters and digits"
+    }
+    if username != "" && strings.EqualFold(password, username) {
+        return "must not match the username"
+    }
+    return ""
+}
+
+func validateEmail(email string) string {
+    if email == "" {
+        return "required"
+    }
+    addr, err := mail.ParseAddress(email)
+    if err != nil || addr.Address != email || len(email) > 254 {
+        return "invalid format"
+    }
+    at := strings.LastIndex(email, "@")
+    if !strings.Contains(email[at+1:], ".") {
+        return "invalid format"
+    }
+    return ""
+}
+
+// parseDate parses a required YYYY-MM-DD field.
+func parseDate(errs fieldErrors, field, v string) *time.Time {
+    if v == "" {
+        errs.add(field, "required")
+        return nil
+    }
+    t, err := time.Parse("2006-01-02", v)
+    if err != nil {
+        errs.add(field, "must be a date in YYYY-MM-DD format")
+        return nil
+    }
+    return &t
+}
+
+// identity is the traveller document data collected at registration and
+// editable from the profile.
+type identity struct {
+    Nationality            string
+    Name                   string
+    PassportNumber         string
+    PassportExpirationDate string
+    DateOfBirth            string
+    Gender                 string
+}
+
+// validIdentity is an identity with fields normalized and dates parsed.
+type validIdentity struct {
+    identity
+    PassportExpiration time.Time
+    Birth              time.Time
+}
+
+// validateIdentity checks every identity field; all of them are required.
+func validateIdentity(errs fieldErrors, in identity, now time.Time) validIdentity {
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    out := validIdentity{identity: in}
+
+    out.Nationality = strings.ToUpper(strings.TrimSpace(in.Nationality))
+    if out.Nationality == "" {
+        errs.add("nationality", "required")
+    } else if !validNationality(out.Nationality) {
+        errs.add("nationality", "must be an ISO 3166-1 alpha-2 country code")
+    }
+
+    out.Name = strings.TrimSpace(in.Name)
+    if out.Name == "" {
+        errs.add("name", "required")
+    } else if utf8.RuneCountInString(out.Name) > 100 {
+        errs.add("name", "must be at most 100 characters")
+    }
+
+    // the format depends on the issuing country
+    out.PassportNumber = validation.Normalize(in.PassportNumber)
+    if out.PassportNumber == "" {
+        errs.add("passportNumber", "required")
+    } else if err := validation.CheckPassport(out.Nationality, out.PassportNumber); err != nil {
+        errs.add("passportNumber", err.Error())
+    }
+
+    if exp := parseDate(errs, "passportExpirationDate", in.PassportExpirationDate); exp != nil {
+        if validation.CheckExpiry(*exp, now) != nil {
+            errs.add("passportExpirationDate", "passport has expired")
+        }
+        out.PassportExpiration = *exp
+    }
+
+    if dob := parseDate(errs, "dateOfBirth", in.DateOfBirth); dob != nil {
+        if dob.After(today) {
+            errs.add("dateOfBirth", "must not be in the future")
+        } else if dob.Year() < 1900 {
+            errs.add("dateOfBirth", "must be after 1900-01-01")
+        }
+        out.Birth = *dob
+    }
+
+    if in.Gender != "male" && in.Gender != "female" {
+        errs.add("gender", "must be male or female")
+    }
+    return out
+}
+
+// validRegistration is a registerRequest that passed validateRegister, with
+// fields normalized and dates parsed.
+type validRegistration struct {
+    registerRequest
+    PassportExpiration time.Time
+    Birth              time.Time
+}
+
+func validateRegister(req registerRequest, now time.Time) (validRegistration, fieldErrors) {
+    errs := fieldErrors{}
+    out := validRegistration{registerRequest: req}
+
+    id := validateIdentity(errs, identity{
+        Nationality: req.Nationality, Name: req.Name, PassportNumber: req.PassportNumber,
+        PassportExpirationDate: req.PassportExpirationDate, DateOfBirth: req.DateOfBirth, Gender: req.Gender,
+    }, now)
+    out.Nationality, out.Name, out.PassportNumber = id.Nationality, id.Name, id.PassportNumber
+    out.PassportExpiration, out.Birth = id.PassportExpiration, id.Birth
+
+    out.Username = strings.TrimSpace(req.Username)
+    if out.Username == "" {
+        errs.add("username", "required")
+    } else if !usernamePattern.MatchString(out.Username) {
+        errs.add("username", "must be 6-30 letters, digits or underscores, starting with a letter")
+    }
+
+    if req.Password == "" {
+        errs.add("password", "required")
+    } else if reason := validatePassword(req.Password, out.Username); reason != "" {
+        errs.add("password", reason)
+    }
+
+    out.Email = strings.TrimSpace(req.Email)
+    if reason := validateEmail(out.Email); reason != "" {
+        errs.add("email", reason)
+    }
+
+    if !req.AgreeTerms {
+        errs.add("agreeTerms", "must be accepted")
+    }
+    return out, errs
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/url"
+
+    "cs3604/backend/internal/notify"
+
+    "github.com/gin-gonic/gin"
+    "gorm.io/gorm"
+)
+
+// Account statuses stored in users.status.
+const (
+    statusPending = "pending"
+    statusActive  = "active"
+)
+
+type verifyEmailRequest struct {
+    Token string `json:"token"`
+}
+
+type resendVerificationRequest struct {
+    Email string `json:"email"`
+}
+
+func (s *Server) sendVerificationEmail(ctx context.Context, userID, email string) error {
+    token, err := s.issueUserToken(userID, tokenVerifyEmail, "", s.Auth.EmailVerifyTTL)
+    if err != nil {
+        return err
+    }
+    link := s.Auth.AppBaseURL + "/verify-email?token=" + url.QueryEscape(token)
+    return s.Mailer.Send(ctx, notify.Message{
+        To:      email,
+        Subject: "Confirm your 12306 email address",
+        Body:    fmt.Sprintf("Welcome to 12306!\n\nOpen the link below within %s to activate your account:\n%s", s.Auth.EmailVerifyTTL, link),
+    })
+}
+
+func (s *Server) verifyEmail(c *gin.Context) {
+    var req verifyEmailRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Token == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"bad request"})
+        return
+    }
+    var userID string
+    err := s.DB.Transaction(func(tx *gorm.DB) error {
+        var err error
+        if userID, _, err = consumeUserToken(tx, tokenVerifyEmail, req.Token); err != nil || userID == "" {
+            return err
+        }
+        return tx.Exec("UPDATE users SET status = ?, updated_at = now() WHERE id = ? AND status = ?", statusActive, userID, statusPending).Error
+    })
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not verify email"})
+        return
+    }
+    if userID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_token","message":"Verification link is invalid or has expired"})
+        return
+    }
+    c.Status(http.StatusNoContent)
+}
+
+// resendVerification mails a fresh link to a pending account. At most one
+// email per minute and five per hour are sent to the same account.
+func (s *Server) resendVerification(c *gin.Context) {
+    var req resendVerificationRequest
+    if err := c.ShouldBindJSON(&req); err != nil || req.Email == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"code":"invalid_parameters","message":"email is required"})
+        return
+    }
+    var user struct{ ID string; Email string }
+    s.DB.Raw("SELECT id, email FROM users WHERE email = ? AND status = ? LIMIT 1", req.Email, statusPending).Scan(&user)
+    if user.ID != "" {
+        if wait := s.tokenMailWait(user.ID, tokenVerifyEmail); wait > 0 {
+            c.Header("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+            c.JSON(http.StatusTooManyRequests, gin.H{"code":"rate_limited","message":"Please wait before requesting another email","details": gin.H{"retryAfterSeconds": int(wait.Seconds())+1}})
+            return
+        }
+        if err := s.sendVerificationEmail(c.Request.Context(), user.ID, user.Email); err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"code":"server_error","message":"could not send email"})
+            return
+        }
+    }
+    c.JSON(http.StatusAccepted, gin.H{"message": "If the account is awaiting verification, a new link has been sent"})
+}
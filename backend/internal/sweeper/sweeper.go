@@ -0,0 +1,128 @@
+// Package sweeper expires overdue preorders and cancels unpaid orders past
+// their payment deadline so that the seats they hold go back on sale. Seats
+// of preorders are returned by the trg_preorder_release trigger when a
+// preorder leaves the active status; those of orders by the order's
+// transition to canceled.
+package sweeper
+
+import (
+    "context"
+    "expvar"
+    "log"
+    "time"
+
+    "cs3604/backend/internal/config"
+    "cs3604/backend/internal/orders"
+
+    "gorm.io/gorm"
+)
+
+// Metrics are published under "preorder_sweeper" in /debug/vars.
+var (
+    metrics         = expvar.NewMap("preorder_sweeper")
+    metricBatches   = new(expvar.Int)
+    metricErrors    = new(expvar.Int)
+    metricPreorders = new(expvar.Int)
+    metricOrders    = new(expvar.Int)
+    metricSeats     = new(expvar.Int)
+    metricLastSweep = new(expvar.String)
+)
+
+func init() {
+    metrics.Set("batches", metricBatches)
+    metrics.Set("errors", metricErrors)
+    metrics.Set("preorders_expired", metricPreorders)
+    metrics.Set("orders_canceled", metricOrders)
+    metrics.Set("seats_released", metricSeats)
+    metrics.Set("last_sweep", metricLastSweep)
+}
+
+// Result counts what one batch expired or canceled.
+type Result struct {
+    Preorders int64
+    Orders    int64
+    Seats     int64
+}
+
+type Sweeper struct {
+    DB        *gorm.DB
+    Interval  time.Duration
+    BatchSize int
+}
+
+func New(db *gorm.DB, cfg config.SweeperConfig) *Sweeper {
+    return &Sweeper{DB: db, Interval: cfg.Interval, BatchSize: cfg.BatchSize}
+}
+
+// SweepBatch expires up to BatchSize overdue preorders and cancels up to
+// BatchSize unpaid orders, each in one transaction. Rows locked by another
+// instance (or by a cancel in flight) are skipped, so any number of
+// sweepers can run against the same database.
+func (s *Sweeper) SweepBatch(ctx context.Context) (Result, error) {
+    var res Result
+    err := s.DB.WithContext(ctx).Raw(`WITH due AS (
+                                        SELECT id FROM preorders
+                                        WHERE status = 'active' AND expires_at <= now()
+                                        ORDER BY expires_at LIMIT ?
+                                        FOR UPDATE SKIP LOCKED
+                                      ), expired AS (
+                                        UPDATE preorders p SET status = 'expired'
+                                        FROM due WHERE p.id = due.id
+                                        RETURNING p.hold_quantity
+                                      )
+                                      SELECT count(*) AS preorders, COALESCE(sum(hold_quantity), 0) AS seats FROM expired`,
+        s.BatchSize).Scan(&res).Error
+    if err == nil {
+        var seats int64
+        res.Orders, seats, err = orders.New(s.DB).ExpireUnpaid(ctx, s.BatchSize)
+        res.Seats += seats
+    }
+    if err != nil {
+        metricErrors.Add(1)
+        return Result{}, err
+    }
+    metricBatches.Add(1)
+    metricPreorders.Add(res.Preorders)
+    metricOrders.Add(res.Orders)
+    metricSeats.Add(res.Seats)
+    return res, nil
+}
+
+// Sweep runs batches until the backlog is cleared and returns the totals.
+func (s *Sweeper) Sweep(ctx context.Context) (Result, error) {
+    var total Result
+    defer func() { metricLastSweep.Set(time.Now().UTC().Format(time.RFC3339)) }()
+    for ctx.Err() == nil {
+        res, err := s.SweepBatch(ctx)
+        total.Preorders += res.Preorders
+        total.Orders += res.Orders
+        total.Seats += res.Seats
+        if err != nil || (res.Preorders < int64(s.BatchSize) && res.Orders < int64(s.BatchSize)) {
+            return total, err
+        }
+    }
+    return total, ctx.Err()
+}
+
+// Run sweeps every Interval until ctx is done. A zero Interval disables it.
+func (s *Sweeper) Run(ctx context.Context) {
+    if s.Interval <= 0 || s.BatchSize <= 0 {
+        log.Printf("preorder sweeper disabled")
+        return
+    }
+    t := time.NewTicker(s.Interval)
+    defer t.Stop()
+    for {
+        res, err := s.Sweep(ctx)
+        if err != nil && ctx.Err() == nil {
+            log.Printf("preorder sweeper: %v", err)
+        } else if res.Preorders > 0 || res.Orders > 0 {
+            log.Printf("preorder sweeper: expired %d preorders, canceled %d unpaid orders, released %d seats", res.Preorders, res.Orders, res.Seats)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-t.C:
+        }
+    }
+}
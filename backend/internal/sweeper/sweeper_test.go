@@ -0,0 +1,149 @@
+package sweeper
+
+import (
+    "context"
+    "expvar"
+    "sync"
+    "testing"
+    "time"
+
+    "cs3604/backend/internal/config"
+    "cs3604/backend/internal/db"
+    "cs3604/backend/internal/orders"
+    "cs3604/backend/internal/repo"
+    "github.com/stretchr/testify/require"
+)
+
+func TestSweepExpiresOverduePreordersOnce(t *testing.T) {
+    gdb, err := db.Open(config.LoadDB().DSN())
+    require.NoError(t, err)
+    r := repo.New(gdb)
+
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    require.Len(t, sts, 2)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else { shh = s.ID } }
+    // a train and date no other test books, so the seat counts below are
+    // this test's alone
+    svcID, segID, err := r.ServiceAndSegment("D6", time.Now().AddDate(0, 0, 1), bjp, shh)
+    require.NoError(t, err)
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+
+    uid, err := r.CreateUser("test_user_sweeper", "test_user_sweeper@example.com", "dummyhash")
+    require.NoError(t, err)
+    defer r.DeleteUser(uid)
+
+    var overdue []string
+    for i := 0; i < 5; i++ {
+        pid, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 1, time.Now().Add(-time.Minute))
+        require.NoError(t, err)
+        overdue = append(overdue, pid)
+    }
+    live, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 1, time.Now().Add(10*time.Minute))
+    require.NoError(t, err)
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-6, left)
+
+    // several instances with small batches share the work without
+    // expiring anything twice
+    seatsBefore := metricSeats.Value()
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var total Result
+    errs := make(chan error, 3)
+    for i := 0; i < 3; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            res, err := (&Sweeper{DB: gdb, BatchSize: 2}).Sweep(context.Background())
+            errs <- err
+            mu.Lock()
+            total.Preorders += res.Preorders
+            total.Seats += res.Seats
+            mu.Unlock()
+        }()
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        require.NoError(t, err)
+    }
+    require.GreaterOrEqual(t, total.Seats, int64(len(overdue)))
+    require.Equal(t, total.Seats, metricSeats.Value()-seatsBefore)
+    require.NotNil(t, expvar.Get("preorder_sweeper"))
+
+    var statuses []string
+    require.NoError(t, gdb.Raw("SELECT status::text FROM preorders WHERE id IN ? ORDER BY status", overdue).Scan(&statuses).Error)
+    require.Equal(t, []string{"expired", "expired", "expired", "expired", "expired"}, statuses)
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-1, left)
+
+    require.NoError(t, r.UpdatePreorderStatus(live, "canceled"))
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore, left)
+}
+
+func TestSweepCancelsUnpaidOrders(t *testing.T) {
+    gdb, err := db.Open(config.LoadDB().DSN())
+    require.NoError(t, err)
+    r := repo.New(gdb)
+
+    sts, err := r.StationsByCodes([]string{"BJP", "SHH"})
+    require.NoError(t, err)
+    require.Len(t, sts, 2)
+    var bjp, shh string
+    for _, s := range sts { if s.Code == "BJP" { bjp = s.ID } else { shh = s.ID } }
+    svcID, segID, err := r.ServiceAndSegment("D6", time.Now().AddDate(0, 0, 2), bjp, shh)
+    require.NoError(t, err)
+    leftBefore, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+
+    uid, err := r.CreateUser("test_user_sweeper_orders", "test_user_sweeper_orders@example.com", "dummyhash")
+    require.NoError(t, err)
+    defer r.DeleteUser(uid)
+
+    svc := orders.New(gdb)
+    ctx := context.Background()
+    place := func() orders.Order {
+        pid, err := r.CreatePreorder(uid, svcID, segID, bjp, shh, "second", 2, time.Now().Add(10*time.Minute))
+        require.NoError(t, err)
+        o, err := svc.CreateFromPreorder(ctx, uid, pid)
+        require.NoError(t, err)
+        require.WithinDuration(t, time.Now().Add(orders.PaymentWindow), o.ExpiresAt, time.Minute)
+        return o
+    }
+    abandoned, paid, waiting := place(), place(), place()
+    _, err = svc.Transition(ctx, uid, paid.ID, orders.Paid)
+    require.NoError(t, err)
+    require.NoError(t, gdb.Exec("UPDATE orders SET expires_at = now() - interval '1 second' WHERE id IN ?", []string{abandoned.ID, paid.ID}).Error)
+    left, err := r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-6, left)
+
+    // only the unpaid order past its deadline is canceled, through the
+    // order state machine, and its seats go back on sale
+    res, err := (&Sweeper{DB: gdb, BatchSize: 10}).Sweep(ctx)
+    require.NoError(t, err)
+    require.GreaterOrEqual(t, res.Orders, int64(1))
+    for id, want := range map[string]orders.Status{abandoned.ID: orders.Canceled, paid.ID: orders.Paid, waiting.ID: orders.PendingPayment} {
+        o, err := svc.Get(ctx, uid, id)
+        require.NoError(t, err)
+        require.Equal(t, want, o.Status)
+    }
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore-4, left)
+
+    _, err = svc.Transition(ctx, uid, paid.ID, orders.Refunded)
+    require.NoError(t, err)
+    _, err = svc.Transition(ctx, uid, waiting.ID, orders.Canceled)
+    require.NoError(t, err)
+    left, err = r.InventoryLeft(segID, "second")
+    require.NoError(t, err)
+    require.Equal(t, leftBefore, left)
+}
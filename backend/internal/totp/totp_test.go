@@ -0,0 +1,56 @@
+package totp
+
+import (
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+)
+
+func TestCodeAt_RFC6238Vectors(t *testing.T) {
+    key := []byte("12345678901234567890")
+    cases := map[int64]string{
+        59:         "94287082",
+        1111111109: "07081804",
+        1111111111: "14050471",
+        1234567890: "89005924",
+        2000000000: "69279037",
+    }
+    for unix, want := range cases {
+        require.Equal(t, want, codeAt(key, uint64(unix/Period), 8), "t=%d", unix)
+    }
+}
+
+func TestValidate_AcceptsSkewAndRejectsOthers(t *testing.T) {
+    secret, err := GenerateSecret()
+    require.NoError(t, err)
+    now := time.Unix(1700000000, 0)
+
+    code, err := Code(secret, now)
+    require.NoError(t, err)
+    step, ok := Validate(secret, code, now)
+    require.True(t, ok)
+    require.Equal(t, Step(now), step)
+
+    prev, err := Code(secret, now.Add(-Period*time.Second))
+    require.NoError(t, err)
+    _, ok = Validate(secret, prev, now)
+    require.True(t, ok)
+
+    old, err := Code(secret, now.Add(-3*Period*time.Second))
+    require.NoError(t, err)
+    if old != code && old != prev {
+        _, ok = Validate(secret, old, now)
+        require.False(t, ok)
+    }
+
+    _, ok = Validate(secret, "12345", now)
+    require.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+    uri := URI("12306", "alice", "JBSWY3DPEHPK3PXP")
+    require.Contains(t, uri, "otpauth://totp/12306:alice?")
+    require.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+    require.Contains(t, uri, "issuer=12306")
+}
@@ -0,0 +1,166 @@
+// Package validation checks the identity documents travellers present at the
+// gate: mainland resident ID cards, passports and the Hong Kong/Macau and
+// Taiwan travel permits.
+package validation
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// Document types, matching document_type_enum.
+const (
+    Passport      = "passport"
+    ResidentID    = "resident_id"
+    HKMacauPermit = "hk_macau_permit"
+    TaiwanPermit  = "taiwan_permit"
+)
+
+// Errors describe why a document was rejected; their text is shown to users.
+var (
+    ErrFormat      = errors.New("invalid format")
+    ErrChecksum    = errors.New("check digit does not match")
+    ErrRegion      = errors.New("unknown region code")
+    ErrBirthDate   = errors.New("contains an invalid birth date")
+    ErrExpired     = errors.New("document has expired")
+    ErrUnknownType = errors.New("unknown document type")
+)
+
+var (
+    residentIDPattern = regexp.MustCompile(`^[0-9]{17}[0-9X]$`)
+    genericPassport   = regexp.MustCompile(`^[A-Z0-9]{5,20}$`)
+)
+
+// passportPatterns holds the number formats of the passports seen most often;
+// other nationalities only get the generic check.
+var passportPatterns = map[string]*regexp.Regexp{
+    "CN": regexp.MustCompile(`^(E[0-9]{8}|E[A-HJ-NP-Z][0-9]{7}|[GDSP][0-9]{8}|[DSP]E[0-9]{7})$`),
+    "HK": regexp.MustCompile(`^[HK][0-9]{8}$`),
+    "TW": regexp.MustCompile(`^[0-9]{9}$`),
+    "US": regexp.MustCompile(`^([0-9]{9}|[A-Z][0-9]{8})$`),
+    "GB": regexp.MustCompile(`^[0-9]{9}$`),
+    "JP": regexp.MustCompile(`^[A-Z]{2}[0-9]{7}$`),
+    "KR": regexp.MustCompile(`^[MSRODG]([0-9]{8}|[0-9]{3}[A-Z][0-9]{4})$`),
+    "DE": regexp.MustCompile(`^[CFGHJKLMNPRTVWXYZ][CFGHJKLMNPRTVWXYZ0-9]{8}$`),
+    "FR": regexp.MustCompile(`^[0-9]{2}[A-Z]{2}[0-9]{5}$`),
+    "RU": regexp.MustCompile(`^[0-9]{9}$`),
+    "IN": regexp.MustCompile(`^[A-Z][0-9]{7}$`),
+}
+
+// permitFormats maps the permit number formats to the region of the holder.
+var permitFormats = map[string][]struct {
+    pattern *regexp.Regexp
+    holder  string
+}{
+    HKMacauPermit: {
+        // exit-entry permit of mainland residents, card edition
+        {regexp.MustCompile(`^C[0-9A-HJ-NP-Z][0-9]{7}$`), "CN"},
+        // home return permits of Hong Kong and Macau residents
+        {regexp.MustCompile(`^H[0-9]{8}([0-9]{2})?$`), "HK"},
+        {regexp.MustCompile(`^M[0-9]{8}([0-9]{2})?$`), "MO"},
+    },
+    TaiwanPermit: {
+        // travel permit of mainland residents
+        {regexp.MustCompile(`^L[0-9]{8}$`), "CN"},
+        // mainland travel permit of Taiwan residents
+        {regexp.MustCompile(`^[0-9]{8}$`), "TW"},
+    },
+}
+
+// provinces are the first two digits of a resident ID region code.
+var provinces = map[string]bool{
+    "11": true, "12": true, "13": true, "14": true, "15": true,
+    "21": true, "22": true, "23": true,
+    "31": true, "32": true, "33": true, "34": true, "35": true, "36": true, "37": true,
+    "41": true, "42": true, "43": true, "44": true, "45": true, "46": true,
+    "50": true, "51": true, "52": true, "53": true, "54": true,
+    "61": true, "62": true, "63": true, "64": true, "65": true,
+    "71": true, "81": true, "82": true, "83": true,
+}
+
+var checksumWeights = [17]int{7, 9, 10, 5, 8, 4, 2, 1, 6, 3, 7, 9, 10, 5, 8, 4, 2}
+
+// Normalize upper-cases a document number and drops spaces.
+func Normalize(number string) string {
+    return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(number), " ", ""))
+}
+
+// ResidentIDInfo is what an 18-digit resident ID number says about its holder.
+type ResidentIDInfo struct {
+    Region string
+    Birth  time.Time
+    Gender string
+}
+
+// ResidentIDCheckDigit returns the GB 11643 check character for the first 17
+// digits of a resident ID number.
+func ResidentIDCheckDigit(first17 string) byte {
+    sum := 0
+    for i := 0; i < 17; i++ {
+        sum += int(first17[i]-'0') * checksumWeights[i]
+    }
+    return "10X98765432"[sum%11]
+}
+
+// ParseResidentID validates a normalized resident ID number and decodes the
+// birth date and gender it carries.
+func ParseResidentID(number string, now time.Time) (ResidentIDInfo, error) {
+    if !residentIDPattern.MatchString(number) {
+        return ResidentIDInfo{}, fmt.Errorf("%w: must be 17 digits followed by a digit or X", ErrFormat)
+    }
+    if ResidentIDCheckDigit(number[:17]) != number[17] {
+        return ResidentIDInfo{}, ErrChecksum
+    }
+    if !provinces[number[:2]] {
+        return ResidentIDInfo{}, ErrRegion
+    }
+    birth, err := time.Parse("20060102", number[6:14])
+    if err != nil || birth.After(now) || birth.Year() < 1900 {
+        return ResidentIDInfo{}, ErrBirthDate
+    }
+    gender := "female"
+    if (number[16]-'0')%2 == 1 {
+        gender = "male"
+    }
+    return ResidentIDInfo{Region: number[:6], Birth: birth, Gender: gender}, nil
+}
+
+// CheckPassport validates a normalized passport number against the format of
+// the issuing country, falling back to 5-20 letters or digits.
+func CheckPassport(nationality, number string) error {
+    if !genericPassport.MatchString(number) {
+        return fmt.Errorf("%w: must be 5-20 letters or digits", ErrFormat)
+    }
+    if p, ok := passportPatterns[nationality]; ok && !p.MatchString(number) {
+        return fmt.Errorf("%w for a %s passport", ErrFormat, nationality)
+    }
+    return nil
+}
+
+// ParsePermit validates a normalized Hong Kong/Macau or Taiwan permit number
+// and returns the region code of the holder it is issued to.
+func ParsePermit(docType, number string) (string, error) {
+    formats, ok := permitFormats[docType]
+    if !ok {
+        return "", ErrUnknownType
+    }
+    for _, f := range formats {
+        if f.pattern.MatchString(number) {
+            return f.holder, nil
+        }
+    }
+    return "", ErrFormat
+}
+
+// CheckExpiry rejects a document that is no longer valid on now's date. A
+// document is still valid on its expiry date.
+func CheckExpiry(expires, now time.Time) error {
+    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    if expires.Before(today) {
+        return ErrExpired
+    }
+    return nil
+}
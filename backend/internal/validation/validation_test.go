@@ -0,0 +1,75 @@
+package validation
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/require"
+)
+
+func TestParseResidentID(t *testing.T) {
+    now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+    info, err := ParseResidentID("11010519491231002X", now)
+    require.NoError(t, err)
+    require.Equal(t, "110105", info.Region)
+    require.Equal(t, time.Date(1949, 12, 31, 0, 0, 0, 0, time.UTC), info.Birth)
+    require.Equal(t, "female", info.Gender)
+
+    male := "44030420010203123"
+    info, err = ParseResidentID(male+string(ResidentIDCheckDigit(male)), now)
+    require.NoError(t, err)
+    require.Equal(t, "male", info.Gender)
+
+    for number, want := range map[string]error{
+        "110105194912310021": ErrChecksum,
+        "11010519491231002":  ErrFormat,
+        "11010519491231002x": ErrFormat,
+    } {
+        _, err := ParseResidentID(number, now)
+        require.True(t, errors.Is(err, want), "%s: %v", number, err)
+    }
+    for _, first17 := range []string{"99010519491231002", "11010519490231002", "11010520300101002"} {
+        _, err := ParseResidentID(first17+string(ResidentIDCheckDigit(first17)), now)
+        require.Error(t, err, first17)
+    }
+}
+
+func TestCheckPassport(t *testing.T) {
+    require.NoError(t, CheckPassport("CN", "E12345678"))
+    require.NoError(t, CheckPassport("CN", "EA1234567"))
+    require.Error(t, CheckPassport("CN", "P1234567"))
+    require.NoError(t, CheckPassport("JP", "TK1234567"))
+    require.Error(t, CheckPassport("JP", "E12345678"))
+    require.NoError(t, CheckPassport("US", "123456789"))
+    // nationalities without a known format get the generic check
+    require.NoError(t, CheckPassport("NZ", "LA123456"))
+    require.Error(t, CheckPassport("NZ", "#1"))
+}
+
+func TestParsePermit(t *testing.T) {
+    for _, tc := range []struct{ docType, number, holder string }{
+        {HKMacauPermit, "CA1234567", "CN"},
+        {HKMacauPermit, "H12345678", "HK"},
+        {HKMacauPermit, "M1234567801", "MO"},
+        {TaiwanPermit, "L12345678", "CN"},
+        {TaiwanPermit, "12345678", "TW"},
+    } {
+        holder, err := ParsePermit(tc.docType, tc.number)
+        require.NoError(t, err, tc.number)
+        require.Equal(t, tc.holder, holder)
+    }
+    _, err := ParsePermit(HKMacauPermit, "12345678")
+    require.ErrorIs(t, err, ErrFormat)
+    _, err = ParsePermit(Passport, "E12345678")
+    require.ErrorIs(t, err, ErrUnknownType)
+}
+
+func TestCheckExpiry(t *testing.T) {
+    now := time.Date(2025, 6, 1, 23, 0, 0, 0, time.UTC)
+    require.NoError(t, CheckExpiry(time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC), now))
+    // the last valid day still counts
+    require.NoError(t, CheckExpiry(time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), now))
+    require.ErrorIs(t, CheckExpiry(time.Date(2025, 5, 31, 0, 0, 0, 0, time.UTC), now), ErrExpired)
+}
@@ -25,8 +25,24 @@ DO $$ BEGIN
   IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'preorder_status_enum') THEN
     CREATE TYPE preorder_status_enum AS ENUM ('active','expired','canceled');
   END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'order_status_enum') THEN
+    CREATE TYPE order_status_enum AS ENUM ('pending_payment','paid','ticketed','refunded','changed','canceled');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'document_type_enum') THEN
+    CREATE TYPE document_type_enum AS ENUM ('passport','resident_id','hk_macau_permit','taiwan_permit');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'verification_status_enum') THEN
+    CREATE TYPE verification_status_enum AS ENUM ('pending','verified','rejected');
+  END IF;
+  IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'user_role_enum') THEN
+    CREATE TYPE user_role_enum AS ENUM ('customer','support','admin');
+  END IF;
 END $$;
 
+-- Enum values added after the first release: the DO block above skips types
+-- that already exist.
+ALTER TYPE preorder_status_enum ADD VALUE IF NOT EXISTS 'converted';
+
 -- Tables
 CREATE TABLE IF NOT EXISTS users (
   id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -46,6 +62,12 @@ CREATE TABLE IF NOT EXISTS users (
   updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
+-- Columns added after the first release: CREATE TABLE IF NOT EXISTS leaves an
+-- existing table untouched, so databases created earlier get them here.
+-- deleted_at is set when the account is deleted and its personal data anonymized.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role user_role_enum NOT NULL DEFAULT 'customer';
+
 CREATE TABLE IF NOT EXISTS sessions (
   sid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
   user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -56,7 +78,186 @@ CREATE TABLE IF NOT EXISTS sessions (
   ip INET
 );
 
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS remember_me BOOLEAN NOT NULL DEFAULT false;
+-- synchronizer token required in X-CSRF-Token on state-changing requests
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS csrf_token TEXT NOT NULL DEFAULT encode(gen_random_bytes(32), 'hex');
+
 CREATE INDEX IF NOT EXISTS idx_users_login_lookup ON users USING BTREE (username, email, mobile);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id, expires_at);
+
+-- Login attempts: audit trail for brute-force throttling per identifier and per IP
+CREATE TABLE IF NOT EXISTS login_attempts (
+  id BIGSERIAL PRIMARY KEY,
+  identifier CITEXT NOT NULL,
+  ip INET,
+  user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+  success BOOLEAN NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_identifier ON login_attempts(identifier, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip, created_at);
+
+-- Login history shown to users: logins, logouts and session revocations
+CREATE TABLE IF NOT EXISTS login_events (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  identifier CITEXT,
+  event TEXT NOT NULL,
+  outcome TEXT NOT NULL,
+  reason TEXT,
+  ip INET,
+  user_agent TEXT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_events_user ON login_events(user_id, created_at DESC);
+
+-- Single-use tokens mailed to users (password reset, ...); only the sha256 is stored
+CREATE TABLE IF NOT EXISTS user_tokens (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  purpose TEXT NOT NULL,
+  token_hash TEXT UNIQUE NOT NULL,
+  -- purpose-specific data, e.g. the new address for change_email
+  payload TEXT,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user ON user_tokens(user_id, purpose);
+
+-- SMS one-time codes for mobile binding and passwordless login; only the sha256 is stored
+CREATE TABLE IF NOT EXISTS otp_codes (
+  id BIGSERIAL PRIMARY KEY,
+  mobile CITEXT NOT NULL,
+  purpose TEXT NOT NULL,
+  user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL,
+  consumed_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_otp_codes_mobile ON otp_codes(mobile, purpose, created_at);
+-- ip is the requester, counted for the per-IP send limit.
+ALTER TABLE otp_codes ADD COLUMN IF NOT EXISTS ip INET;
+CREATE INDEX IF NOT EXISTS idx_otp_codes_ip ON otp_codes(ip, created_at);
+
+-- TOTP two-factor authentication; confirmed_at is NULL while enrollment is pending
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+  secret TEXT NOT NULL,
+  confirmed_at TIMESTAMPTZ,
+  last_step BIGINT,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+
+-- Personal access tokens for Authorization: Bearer; only the sha256 is stored
+CREATE TABLE IF NOT EXISTS api_tokens (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  token_hash TEXT UNIQUE NOT NULL,
+  scopes TEXT[] NOT NULL,
+  expires_at TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens(user_id);
+
+-- Pending second-factor logins: the password was accepted, no session yet
+CREATE TABLE IF NOT EXISTS login_challenges (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  remember_me BOOLEAN NOT NULL DEFAULT false,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  expires_at TIMESTAMPTZ NOT NULL,
+  consumed_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- the identifier the password was checked for; failed codes count against it
+ALTER TABLE login_challenges ADD COLUMN IF NOT EXISTS identifier CITEXT;
+CREATE INDEX IF NOT EXISTS idx_login_challenges_user ON login_challenges(user_id, created_at);
+
+-- External OpenID Connect subjects linked to local accounts
+CREATE TABLE IF NOT EXISTS user_identities (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  issuer TEXT NOT NULL,
+  subject TEXT NOT NULL,
+  email CITEXT,
+  last_login_at TIMESTAMPTZ,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user ON user_identities(user_id);
+
+-- In-flight OIDC authorization requests, keyed by the sha256 of the state parameter
+CREATE TABLE IF NOT EXISTS oidc_auth_requests (
+  state_hash TEXT PRIMARY KEY,
+  nonce TEXT NOT NULL,
+  code_verifier TEXT NOT NULL,
+  remember_me BOOLEAN NOT NULL DEFAULT false,
+  expires_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Travellers a user books for; is_self marks the account holder
+CREATE TABLE IF NOT EXISTS passengers (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  document_type document_type_enum NOT NULL,
+  document_number TEXT NOT NULL,
+  nationality TEXT,
+  date_of_birth DATE NOT NULL,
+  gender gender_enum,
+  ticket_type ticket_type_enum NOT NULL DEFAULT 'adult',
+  verification_status verification_status_enum NOT NULL DEFAULT 'pending',
+  is_self BOOLEAN NOT NULL DEFAULT false,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  CONSTRAINT passengers_document_key UNIQUE (user_id, document_type, document_number)
+);
+
+-- NULL for long-term resident ID cards
+ALTER TABLE passengers ADD COLUMN IF NOT EXISTS document_expiration_date DATE;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_passengers_self ON passengers(user_id) WHERE is_self;
+
+-- At most 15 passengers per user. The owner's row is locked first so that
+-- concurrent inserts for the same user are counted one at a time.
+CREATE OR REPLACE FUNCTION enforce_passenger_limit() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+  PERFORM 1 FROM users WHERE id = NEW.user_id FOR UPDATE;
+  IF (SELECT count(*) FROM passengers WHERE user_id = NEW.user_id) >= 15 THEN
+    RAISE EXCEPTION 'passenger limit reached' USING ERRCODE = 'check_violation', CONSTRAINT = 'passengers_limit';
+  END IF;
+  RETURN NEW;
+END;$$;
+
+DROP TRIGGER IF EXISTS trg_passenger_limit ON passengers;
+CREATE TRIGGER trg_passenger_limit
+BEFORE INSERT ON passengers
+FOR EACH ROW EXECUTE FUNCTION enforce_passenger_limit();
 
 CREATE TABLE IF NOT EXISTS stations (
   id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
@@ -139,6 +340,87 @@ CREATE TABLE IF NOT EXISTS preorders (
 
 CREATE INDEX IF NOT EXISTS idx_preorders_active ON preorders(status, expires_at);
 
+-- One row per held seat. Traveller details are copied from the saved
+-- passenger so the booking is unaffected if that passenger is edited or removed.
+CREATE TABLE IF NOT EXISTS preorder_passengers (
+  id BIGSERIAL PRIMARY KEY,
+  preorder_id UUID NOT NULL REFERENCES preorders(id) ON DELETE CASCADE,
+  passenger_id UUID REFERENCES passengers(id) ON DELETE SET NULL,
+  name TEXT NOT NULL,
+  document_type document_type_enum NOT NULL,
+  document_number TEXT NOT NULL,
+  ticket_type ticket_type_enum NOT NULL,
+  UNIQUE (preorder_id, passenger_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_preorder_passengers_preorder ON preorder_passengers(preorder_id);
+
+-- Orders confirm a preorder: its seats move to the order instead of going
+-- back to inventory. Allowed status changes are enforced in internal/orders.
+-- Orders outlive the rolling window, so references into it are SET NULL.
+CREATE TABLE IF NOT EXISTS orders (
+  id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  preorder_id UUID UNIQUE REFERENCES preorders(id) ON DELETE SET NULL,
+  status order_status_enum NOT NULL DEFAULT 'pending_payment',
+  total_cents INTEGER NOT NULL,
+  currency TEXT NOT NULL DEFAULT 'CNY',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_orders_user ON orders(user_id, created_at);
+-- Unpaid orders are canceled by the sweeper once expires_at passes, which
+-- gives their seats back. Orders created before the column get the default
+-- payment window from now.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ NOT NULL DEFAULT now() + interval '30 minutes';
+CREATE INDEX IF NOT EXISTS idx_orders_unpaid ON orders(expires_at) WHERE status = 'pending_payment';
+
+-- One row per seat; traveller fields are NULL for single-seat preorders made
+-- without passengers and after the account is deleted.
+CREATE TABLE IF NOT EXISTS order_items (
+  id BIGSERIAL PRIMARY KEY,
+  order_id UUID NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+  train_service_id BIGINT REFERENCES train_services(id) ON DELETE SET NULL,
+  segment_id BIGINT REFERENCES service_segments(id) ON DELETE SET NULL,
+  train_no TEXT NOT NULL,
+  service_date DATE NOT NULL,
+  from_station_id UUID NOT NULL REFERENCES stations(id),
+  to_station_id UUID NOT NULL REFERENCES stations(id),
+  seat_type seat_type_enum NOT NULL,
+  ticket_type ticket_type_enum NOT NULL DEFAULT 'adult',
+  passenger_name TEXT,
+  document_type document_type_enum,
+  document_number TEXT,
+  price_cents INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_items_order ON order_items(order_id);
+
+-- Requests sent with an Idempotency-Key and their responses, replayed when
+-- the client retries. status_code is NULL while the first request runs.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  id BIGSERIAL PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  key TEXT NOT NULL,
+  request_hash TEXT NOT NULL,
+  status_code INTEGER,
+  content_type TEXT,
+  response_body BYTEA,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  UNIQUE (user_id, key)
+);
+-- lease_until is pushed forward while the claiming request runs; an
+-- unfinished key may only be taken over once it has lapsed.
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS lease_until TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Fare of one ticket from the seat class price: children pay half and
+-- students 75%, rounded to the nearest fen.
+CREATE OR REPLACE FUNCTION ticket_price_cents(base INTEGER, t ticket_type_enum) RETURNS INTEGER LANGUAGE sql IMMUTABLE AS $$
+  SELECT CASE t WHEN 'child' THEN round(base * 0.5)::int WHEN 'student' THEN round(base * 0.75)::int ELSE base END
+$$;
+
 -- Triggers: 14-day range enforcement for service_date
 CREATE OR REPLACE FUNCTION enforce_service_date_range() RETURNS trigger LANGUAGE plpgsql AS $$
 BEGIN
@@ -159,7 +441,7 @@ BEGIN
   UPDATE segment_seat_inventory SET left_seats = left_seats - NEW.hold_quantity
   WHERE segment_id = NEW.segment_id AND seat_type = NEW.seat_type AND left_seats >= NEW.hold_quantity;
   IF NOT FOUND THEN
-    RAISE EXCEPTION 'not enough seats';
+    RAISE EXCEPTION 'not enough seats' USING ERRCODE = 'check_violation', CONSTRAINT = 'seat_inventory';
   END IF;
   RETURN NEW;
 END;$$;